@@ -0,0 +1,111 @@
+package backcast
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/leedo/backcast/model"
+)
+
+func (a *App) loadHostLimits(ctx context.Context) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	limits, err := model.GetHostLimits(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range limits {
+		a.limiter.setOverride(l)
+	}
+
+	return nil
+}
+
+func (a *App) hostsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(a.limiter.status()); err != nil {
+		jsonError(err, w)
+		return
+	}
+}
+
+func (a *App) updateHostHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+
+	var l model.HostLimit
+
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&l); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	l.Host = strings.ToLower(ps.ByName("host"))
+
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	defer tx.Rollback()
+
+	if err := model.SetHostLimit(ctx, l, tx); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+	a.limiter.setOverride(l)
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(l); err != nil {
+		jsonError(err, w)
+		return
+	}
+}
+
+func (a *App) deleteHostHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	host := strings.ToLower(ps.ByName("host"))
+
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	defer tx.Rollback()
+
+	if err := model.DeleteHostLimit(ctx, host, tx); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+	a.limiter.deleteOverride(host)
+
+	fmt.Fprint(w, `{"status":"ok"}`)
+}
@@ -4,11 +4,10 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"time"
+	"sync"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/leedo/backcast/model"
@@ -19,12 +18,38 @@ import (
 type App struct {
 	config  Config
 	db      *sql.DB
-	refresh chan model.Feed
+	writeDB *sql.DB
+	wake    chan struct{}
+	reindex chan struct{}
+	fetcher *fetcher
+	limiter *hostLimiter
+	sources map[string]Source
+
+	writeLock *sync.Mutex
+	sealer    *sealer
+	robots    *robotsCache
 }
 
 func NewApp(c Config) (App, error) {
+	c = c.withDefaults()
+
+	if c.InstanceID == "" {
+		host, _ := os.Hostname()
+		c.InstanceID = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+
 	a := App{config: c}
 
+	s, err := loadSecretKey(c.SecretKeyFile)
+	if err != nil {
+		return a, err
+	}
+	a.sealer = s
+
+	if c.PublicURL != "" && s == nil {
+		return a, fmt.Errorf("WebSub subscriptions need a secret key to seal hub secrets with")
+	}
+
 	if _, err := os.Stat(c.File); os.IsNotExist(err) {
 		log.Printf("creating new database file %s", c.File)
 		file, err := os.Create(c.File)
@@ -34,19 +59,42 @@ func NewApp(c Config) (App, error) {
 		file.Close()
 	}
 
-	db, err := sql.Open("sqlite3", a.dsn())
+	db, err := sql.Open("sqlite3", a.dsn("deferred"))
+	if err != nil {
+		return a, err
+	}
+
+	writeDB, err := sql.Open("sqlite3", a.dsn("immediate"))
 	if err != nil {
+		db.Close()
 		return a, err
 	}
 
 	a.db = db
-	a.refresh = make(chan model.Feed)
+	a.writeDB = writeDB
+	a.wake = make(chan struct{}, 1)
+	a.reindex = make(chan struct{}, 1)
+	a.fetcher = newFetcher(c)
+	a.limiter = newHostLimiter(c)
+	a.robots = newRobotsCache(c, a.fetcher, a.limiter)
+	a.registerSources()
+	a.writeLock = &sync.Mutex{}
 
 	return a, nil
 }
 
-func (a *App) dsn() string {
-	return fmt.Sprintf("file:%s", a.config.File)
+// dsn opens the database with the given transaction locking mode.
+func (a *App) dsn(txlock string) string {
+	return fmt.Sprintf("file:%s?_busy_timeout=5000&_journal_mode=WAL&_txlock=%s", a.config.File, txlock)
+}
+
+// beginWrite starts a transaction with BEGIN IMMEDIATE, for the scanner's
+// leases and commits. A deferred transaction that reads and then writes
+// fails outright, rather than waiting out the busy timeout, when another
+// process sharing the file committed in between. Reads stay deferred so
+// they never wait on a writer.
+func (a *App) beginWrite() (*sql.Tx, error) {
+	return a.writeDB.Begin()
 }
 
 func (a *App) Run(ctx context.Context) {
@@ -56,107 +104,113 @@ func (a *App) Run(ctx context.Context) {
 	}
 
 	defer a.db.Close()
+	defer a.writeDB.Close()
+
+	if err := a.loadHostLimits(ctx); err != nil {
+		log.Fatal(err)
+	}
 
+	go a.startBackfill(ctx)
 	go a.startScanner(ctx)
+	if a.config.PublicURL != "" {
+		go a.startWebSub(ctx)
+	}
 
+	log.Printf("listening on %s", a.config.Listen)
+	log.Fatal(http.ListenAndServe(a.config.Listen, a.routes()))
+}
+
+func (a *App) routes() *httprouter.Router {
 	router := httprouter.New()
 	router.GET("/api/feed/:id", a.feedHandler)
+	router.GET("/api/feeds/broken", a.brokenFeedsHandler)
+	router.GET("/api/feeds/duplicates", a.duplicateFeedsHandler)
+	router.POST("/api/feed/:id/merge/:other", a.mergeFeedHandler)
 	router.POST("/api/feed", a.createFeedHandler)
 	router.PATCH("/api/feed/:id", a.updateFeedHandler)
+	router.POST("/api/feed/:id/preview", a.previewFeedHandler)
+	router.GET("/api/feed/:id/options", a.feedOptionsHandler)
+	router.PUT("/api/feed/:id/options", a.updateFeedOptionsHandler)
+	router.PUT("/api/feed/:id/schedule", a.updateFeedScheduleHandler)
+	router.GET("/api/feed/:id/credentials", a.feedCredentialsHandler)
+	router.PUT("/api/feed/:id/credentials", a.updateFeedCredentialsHandler)
+	router.DELETE("/api/feed/:id/credentials", a.deleteFeedCredentialsHandler)
+	router.GET("/api/feed/:id/tls", a.feedTLSHandler)
+	router.PUT("/api/feed/:id/tls", a.updateFeedTLSHandler)
+	router.DELETE("/api/feed/:id/tls", a.deleteFeedTLSHandler)
+	router.GET("/api/feed/:id/cookies", a.feedCookiesHandler)
+	router.POST("/api/feed/:id/cookies", a.updateFeedCookiesHandler)
+	router.DELETE("/api/feed/:id/cookies", a.deleteFeedCookiesHandler)
+	router.GET("/api/feed/:id/rules", a.feedRulesHandler)
+	router.PUT("/api/feed/:id/rules", a.updateFeedRulesHandler)
+	router.DELETE("/api/feed/:id/rules", a.deleteFeedRulesHandler)
+	router.GET("/api/feed/:id/items", a.feedItemsHandler)
+	router.GET("/api/feed/:id/items/*guid", a.itemHistoryHandler)
+	router.GET("/api/feed/:id/removed.rss", a.removedRSSHandler)
+	router.GET("/api/feed/:id/complete.rss", a.completeRSSHandler)
 	router.GET("/api/feed/:id/history", a.feedHistoryHandler)
 	router.GET("/api/feed/:id/rss", a.feedRSSHandler)
 	router.GET("/api/feed/:id/rss/:rev", a.feedRevisionRSSHandler)
-
-	log.Printf("listening on %s", a.config.Listen)
-	log.Fatal(http.ListenAndServe(a.config.Listen, router))
+	router.GET("/api/feed/:id/websub", a.feedSubscriptionHandler)
+	router.GET("/api/jobs/:id", a.jobHandler)
+	router.GET("/api/admin/hosts", a.hostsHandler)
+	router.PUT("/api/admin/hosts/:host", a.updateHostHandler)
+	router.DELETE("/api/admin/hosts/:host", a.deleteHostHandler)
+	router.GET("/api/admin/hosts/:host/tls", a.hostTLSHandler)
+	router.PUT("/api/admin/hosts/:host/tls", a.updateHostTLSHandler)
+	router.DELETE("/api/admin/hosts/:host/tls", a.deleteHostTLSHandler)
+	router.GET("/api/admin/rules", a.globalRulesHandler)
+	router.PUT("/api/admin/rules", a.updateGlobalRulesHandler)
+	router.DELETE("/api/admin/rules", a.deleteGlobalRulesHandler)
+	router.GET("/websub/:id", a.websubVerifyHandler)
+	router.POST("/websub/:id", a.websubContentHandler)
+
+	return router
 }
 
-func (a *App) startScanner(ctx context.Context) error {
-	t := time.NewTicker(1 * time.Minute)
-
-	for {
-		select {
-		case f := <-a.refresh:
-			log.Printf("updating feed %d (%s)", f.ID, f.URL)
-			ok, err := a.updateFeed(ctx, f)
-			if err != nil {
-				log.Printf("failed to update feed %d (%s): %v", f.ID, f.URL, err)
-			}
-			if ok {
-				log.Printf("updated feed %d (%s)", f.ID, f.URL)
-			}
-		case <-t.C:
-			log.Println("scanning for stale feeds")
-			if err := a.updateStaleFeeds(ctx); err != nil {
-				log.Printf("%v", err)
-			}
-		case <-ctx.Done():
-			return ctx.Err()
-		}
-	}
-}
-
-func (a *App) updateStaleFeeds(ctx context.Context) error {
-	tx, err := a.db.Begin()
-	if err != nil {
-		return err
-	}
+func (a *App) loadFeedSettings(ctx context.Context, f model.Feed, tx *sql.Tx) (feedSettings, error) {
+	var (
+		s   feedSettings
+		err error
+	)
 
-	feeds, err := model.FindStaleFeeds(ctx, 1*time.Hour, 5, tx)
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-	for _, f := range feeds {
-		log.Printf("checking feed %d (%s) for updates", f.ID, f.URL)
-		ok, err := a.updateFeed(ctx, f)
-		if err != nil {
-			log.Printf("failed to update feed %d (%s): %v", f.ID, f.URL, err)
-		}
-		if ok {
-			log.Printf("updated feed %d (%s)", f.ID, f.URL)
-		}
+	if s.Options, err = f.GetFetchOptions(ctx, tx); err != nil {
+		return s, err
 	}
 
-	tx.Commit()
-	return nil
-}
-
-func (a *App) updateFeed(ctx context.Context, f model.Feed) (bool, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", f.URL, nil)
+	stored, err := f.GetCredentials(ctx, tx)
 	if err != nil {
-		return false, err
+		return s, err
 	}
 
-	tx, err := a.db.Begin()
-	if err != nil {
-		return false, err
+	if stored.Configured {
+		if s.Credentials, err = a.sealer.openCredentials(stored.Data, f.ID); err != nil {
+			return s, fmt.Errorf("could not decrypt credentials: %v", err)
+		}
 	}
 
-	r, err := f.GetCurrentRevision(ctx, tx)
-	if err == nil && r.Etag != "" {
-		req.Header.Add("If-None-Match", r.Etag)
+	if s.TLS, err = a.loadTLSSettings(ctx, f, tx); err != nil {
+		return s, err
 	}
 
-	resp, err := http.Get(f.URL)
-	if err != nil {
-		return false, err
+	if s.Options.Cookies {
+		if s.Cookies, err = loadCookieJar(ctx, feedHost(f.URL), tx); err != nil {
+			return s, err
+		}
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return false, err
-	}
+	return s, nil
+}
 
-	contentType := resp.Header.Get("Content-Type")
-	newEtag := resp.Header.Get("Etag")
-	ok, err := f.CommitDiff(ctx, string(body), newEtag, contentType, tx)
-	if err != nil {
-		tx.Rollback()
-		return false, err
+func (a *App) moveFeed(ctx context.Context, f model.Feed, url string, reason string, tx *sql.Tx) error {
+	other, err := model.GetFeedByURL(ctx, url, tx)
+	if err == nil && other.ID != f.ID {
+		log.Printf("not moving feed %d (%s) to %s, already tracked as feed %d", f.ID, f.URL, url, other.ID)
+		return f.RefuseMove(ctx, url, fmt.Sprintf("already tracked as feed %d", other.ID), tx)
+	} else if err != nil && err != sql.ErrNoRows {
+		return err
 	}
 
-	tx.Commit()
-
-	return ok, nil
+	log.Printf("moving feed %d from %s to %s: %s", f.ID, f.URL, url, reason)
+	return f.MoveURL(ctx, url, reason, tx)
 }
@@ -0,0 +1,94 @@
+package backcast
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/leedo/backcast/model"
+)
+
+// newTestApp opens an app on a fresh database in a temporary directory.
+// Nothing is started, tests drive the pipeline directly.
+func newTestApp(t *testing.T, c Config) *App {
+	t.Helper()
+
+	c.File = filepath.Join(t.TempDir(), "test.db")
+
+	a, err := NewApp(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.initSchema(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		a.db.Close()
+		a.writeDB.Close()
+	})
+
+	return &a
+}
+
+func addTestFeed(t *testing.T, a *App, url string) model.Feed {
+	t.Helper()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer tx.Rollback()
+
+	f, err := model.CreateFeed(context.Background(), url, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
+
+// reloadFeed reads the feed back, as the scanner would before its next
+// check.
+func reloadFeed(t *testing.T, a *App, f model.Feed) model.Feed {
+	t.Helper()
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer tx.Rollback()
+
+	f, err = model.GetFeed(context.Background(), strconv.FormatInt(f.ID, 10), tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
+
+func feedHistory(t *testing.T, a *App, f model.Feed) []model.Revision {
+	t.Helper()
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer tx.Rollback()
+
+	history, err := f.History(context.Background(), tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return history
+}
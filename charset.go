@@ -0,0 +1,181 @@
+package backcast
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+const (
+	charsetUTF8    = "utf-8"
+	charsetLatin1  = "iso-8859-1"
+	charsetCP1252  = "windows-1252"
+	charsetUTF16LE = "utf-16le"
+	charsetUTF16BE = "utf-16be"
+)
+
+var charsetAliases = map[string]string{
+	"utf-8":        charsetUTF8,
+	"utf8":         charsetUTF8,
+	"us-ascii":     charsetUTF8,
+	"ascii":        charsetUTF8,
+	"iso-8859-1":   charsetLatin1,
+	"iso8859-1":    charsetLatin1,
+	"iso_8859-1":   charsetLatin1,
+	"latin1":       charsetLatin1,
+	"latin-1":      charsetLatin1,
+	"l1":           charsetLatin1,
+	"windows-1252": charsetCP1252,
+	"cp1252":       charsetCP1252,
+	"x-cp1252":     charsetCP1252,
+	"utf-16":       charsetUTF16BE,
+	"utf-16le":     charsetUTF16LE,
+	"utf-16be":     charsetUTF16BE,
+}
+
+// windows-1252 differs from latin1 only in 0x80-0x9F. The five bytes it
+// leaves undefined map to the matching C1 control so decoding round-trips.
+var cp1252High = [32]rune{
+	0x20AC, 0x0081, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+	0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0x008D, 0x017D, 0x008F,
+	0x0090, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0x009D, 0x017E, 0x0178,
+}
+
+var xmlEncoding = regexp.MustCompile(`^<\?xml[^>]*encoding\s*=\s*["']([A-Za-z0-9._-]+)["']`)
+
+func normalizeCharset(name string) string {
+	return charsetAliases[strings.ToLower(strings.TrimSpace(name))]
+}
+
+// detectCharset looks for a byte order mark, then the Content-Type
+// charset, then the XML declaration. It returns "" if the encoding is
+// unknown or not one we can transcode.
+func detectCharset(contentType string, body []byte) string {
+	switch {
+	case bytes.HasPrefix(body, []byte{0xEF, 0xBB, 0xBF}):
+		return charsetUTF8
+	case bytes.HasPrefix(body, []byte{0xFF, 0xFE}):
+		return charsetUTF16LE
+	case bytes.HasPrefix(body, []byte{0xFE, 0xFF}):
+		return charsetUTF16BE
+	}
+
+	var declared string
+	if m := xmlEncoding.FindSubmatch(body); m != nil {
+		declared = normalizeCharset(string(m[1]))
+	}
+
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		if cs := normalizeCharset(params["charset"]); cs != "" {
+			// servers commonly label UTF-8 feeds as latin1, trust the
+			// document when it agrees with its own bytes
+			if (cs == charsetLatin1 || cs == charsetCP1252) && declared == charsetUTF8 && utf8.Valid(body) {
+				return charsetUTF8
+			}
+			return cs
+		}
+	}
+
+	return declared
+}
+
+func decodeCharset(charset string, b []byte) (string, error) {
+	switch charset {
+	case charsetLatin1, charsetCP1252:
+		var sb strings.Builder
+		for _, c := range b {
+			if charset == charsetCP1252 && c >= 0x80 && c <= 0x9F {
+				sb.WriteRune(cp1252High[c-0x80])
+			} else {
+				sb.WriteRune(rune(c))
+			}
+		}
+		return sb.String(), nil
+	case charsetUTF16LE, charsetUTF16BE:
+		if len(b)%2 != 0 {
+			return "", fmt.Errorf("odd number of bytes in %s body", charset)
+		}
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			if charset == charsetUTF16LE {
+				u[i] = uint16(b[2*i]) | uint16(b[2*i+1])<<8
+			} else {
+				u[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+			}
+		}
+		return string(utf16.Decode(u)), nil
+	default:
+		return "", fmt.Errorf("cannot decode %s", charset)
+	}
+}
+
+func encodeCharset(charset string, s string) ([]byte, error) {
+	switch charset {
+	case charsetLatin1, charsetCP1252:
+		out := make([]byte, 0, len(s))
+		for _, r := range s {
+			c, ok := encodeSingleByte(charset, r)
+			if !ok {
+				return nil, fmt.Errorf("%U cannot be encoded in %s", r, charset)
+			}
+			out = append(out, c)
+		}
+		return out, nil
+	case charsetUTF16LE, charsetUTF16BE:
+		u := utf16.Encode([]rune(s))
+		out := make([]byte, 0, len(u)*2)
+		for _, c := range u {
+			if charset == charsetUTF16LE {
+				out = append(out, byte(c), byte(c>>8))
+			} else {
+				out = append(out, byte(c>>8), byte(c))
+			}
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("cannot encode %s", charset)
+	}
+}
+
+func encodeSingleByte(charset string, r rune) (byte, bool) {
+	if charset == charsetCP1252 {
+		for i, h := range cp1252High {
+			if h == r {
+				return byte(0x80 + i), true
+			}
+		}
+		if r >= 0x80 && r <= 0x9F {
+			return 0, false
+		}
+	}
+	if r < 0x100 {
+		return byte(r), true
+	}
+	return 0, false
+}
+
+// transcode converts a body to UTF-8 for diffing. It returns the charset
+// needed to get the original bytes back, or "" when the body is stored
+// as is, because it is already UTF-8 or would not survive a round trip.
+func transcode(contentType string, body []byte) (string, string) {
+	charset := detectCharset(contentType, body)
+	if charset == "" || charset == charsetUTF8 {
+		return string(body), ""
+	}
+
+	text, err := decodeCharset(charset, body)
+	if err != nil || !utf8.ValidString(text) {
+		return string(body), ""
+	}
+
+	if raw, err := encodeCharset(charset, text); err != nil || !bytes.Equal(raw, body) {
+		return string(body), ""
+	}
+
+	return text, charset
+}
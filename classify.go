@@ -0,0 +1,60 @@
+package backcast
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+)
+
+const (
+	errorDNS     = "dns"
+	errorTLS     = "tls"
+	errorTimeout = "timeout"
+	errorHTTP4xx = "4xx"
+	errorHTTP5xx = "5xx"
+	errorParse   = "parse"
+	errorNetwork = "network"
+	errorOther   = "other"
+)
+
+func classifyError(err error, resp *FetchResponse) string {
+	if resp != nil {
+		switch {
+		case resp.StatusCode >= 400 && resp.StatusCode < 500:
+			return errorHTTP4xx
+		case resp.StatusCode >= 500:
+			return errorHTTP5xx
+		}
+	}
+
+	var (
+		dnsErr      *net.DNSError
+		netErr      net.Error
+		opErr       *net.OpError
+		bodyErr     bodyError
+		parseErr    parseError
+		recordErr   tls.RecordHeaderError
+		authErr     x509.UnknownAuthorityError
+		hostErr     x509.HostnameError
+		invalidErr  x509.CertificateInvalidError
+		systemRoots x509.SystemRootsError
+	)
+
+	switch {
+	case errors.As(err, &dnsErr):
+		return errorDNS
+	case errors.As(err, &recordErr), errors.As(err, &authErr), errors.As(err, &hostErr),
+		errors.As(err, &invalidErr), errors.As(err, &systemRoots):
+		return errorTLS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return errorTimeout
+	case errors.As(err, &bodyErr), errors.As(err, &parseErr):
+		return errorParse
+	case errors.As(err, &opErr):
+		return errorNetwork
+	}
+
+	return errorOther
+}
@@ -0,0 +1,42 @@
+package backcast
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/leedo/backcast/model"
+)
+
+func TestParkedPageIsParseFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><body>This domain is for sale<br></body></html>"))
+	}))
+	defer srv.Close()
+
+	a := newTestApp(t, Config{MaxFailures: 2})
+	f := addTestFeed(t, a, srv.URL+"/feed.xml")
+
+	for i := 0; i < 2; i++ {
+		_, err := a.checkFeed(context.Background(), reloadFeed(t, a, f))
+		if err == nil {
+			t.Fatalf("check %d of an HTML page did not fail", i+1)
+		}
+	}
+
+	f = reloadFeed(t, a, f)
+	if f.LastErrorClass != errorParse {
+		t.Errorf("error class = %q, want %q", f.LastErrorClass, errorParse)
+	}
+	if f.FailureCount != 2 {
+		t.Errorf("failure count = %d, want 2", f.FailureCount)
+	}
+	if f.Status != model.StatusSuspended {
+		t.Errorf("status = %q, want the feed suspended", f.Status)
+	}
+	if history := feedHistory(t, a, f); len(history) != 1 {
+		t.Errorf("history has %d revisions, want the page archived once", len(history))
+	}
+}
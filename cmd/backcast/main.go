@@ -3,16 +3,76 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
+	"strings"
+	"time"
 
 	"github.com/leedo/backcast"
 )
 
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// commandMap collects name=command flags for exec:// feeds.
+type commandMap map[string][]string
+
+func (m commandMap) String() string {
+	var names []string
+	for name := range m {
+		names = append(names, name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (m commandMap) Set(v string) error {
+	i := strings.IndexByte(v, '=')
+	if i < 1 || len(strings.Fields(v[i+1:])) == 0 {
+		return fmt.Errorf("expected name=command, got %q", v)
+	}
+	m[v[:i]] = strings.Fields(v[i+1:])
+	return nil
+}
+
 func main() {
-	var c backcast.Config
+	c := backcast.Config{Commands: make(map[string][]string)}
 
 	flag.StringVar(&c.File, "db-file", "state.db", "path to an sqlite database file")
 	flag.StringVar(&c.Listen, "listen", "127.0.0.1:8080", "HTTP server listen interface and port")
+	flag.StringVar(&c.UserAgent, "user-agent", "backcast (+https://github.com/leedo/backcast)", "User-Agent header sent when fetching feeds")
+	flag.StringVar(&c.Proxy, "proxy", "", "HTTP, HTTPS or SOCKS5 proxy URL used when fetching feeds")
+	flag.DurationVar(&c.ConnectTimeout, "connect-timeout", 10*time.Second, "maximum time to establish a connection to a feed host")
+	flag.DurationVar(&c.ReadTimeout, "read-timeout", 60*time.Second, "maximum time to wait for a complete feed response")
+	flag.Int64Var(&c.MaxBodySize, "max-body-size", 10<<20, "maximum size in bytes of a decoded feed body")
+	flag.Float64Var(&c.HostRate, "host-rate", 0.5, "default number of requests per second allowed to a single host")
+	flag.IntVar(&c.HostBurst, "host-burst", 2, "default number of requests allowed to a single host in a burst")
+	flag.IntVar(&c.HostConns, "host-conns", 2, "default maximum number of concurrent connections to a single host")
+	flag.IntVar(&c.Workers, "workers", 4, "number of feeds fetched in parallel")
+	flag.IntVar(&c.BatchSize, "batch-size", 100, "maximum number of stale feeds queued per scan")
+	flag.DurationVar(&c.ScanInterval, "scan-interval", 1*time.Minute, "how often to scan for stale feeds")
+	flag.DurationVar(&c.MinInterval, "min-interval", 15*time.Minute, "default shortest time between checks of a feed")
+	flag.DurationVar(&c.MaxInterval, "max-interval", 24*time.Hour, "default longest time between checks of a feed")
+	flag.BoolVar(&c.IgnoreHints, "ignore-hints", false, "ignore publisher caching and polling hints when scheduling checks")
+	flag.IntVar(&c.MaxFailures, "max-failures", 10, "consecutive failures before a feed is suspended, 0 to never suspend")
+	flag.BoolVar(&c.ConfirmFeedMoves, "confirm-feed-moves", true, "fetch an itunes:new-feed-url and check that it is a feed before moving to it")
+	flag.StringVar(&c.SecretKeyFile, "secret-key-file", "", "file with a hex or base64 encoded 32 byte key used to encrypt stored feed secrets")
+	flag.BoolVar(&c.RespectRobots, "respect-robots", false, "skip feeds disallowed by their host's robots.txt")
+	flag.BoolVar(&c.Transcode, "transcode", true, "convert non UTF-8 feeds to UTF-8 before diffing")
+	flag.StringVar(&c.PublicURL, "public-url", "", "URL this server is reachable at by WebSub hubs, enables push subscriptions and needs a secret key")
+	flag.DurationVar(&c.WebSubLease, "websub-lease", 7*24*time.Hour, "lease to request when subscribing to a WebSub hub, 0 to let the hub decide")
+	flag.Var((*stringList)(&c.FileRoots), "file-root", "directory that file:// feeds may be read from, can be repeated")
+	flag.Var(commandMap(c.Commands), "exec", "name=command run for exec://name feeds, can be repeated")
+	flag.StringVar(&c.InstanceID, "instance-id", "", "name this process leases feeds under when sharing a database, defaults to host and pid")
+	flag.DurationVar(&c.LeaseDuration, "lease-duration", 10*time.Minute, "how long a feed stays leased to this process before another may check it")
+	flag.Parse()
 
 	app, err := backcast.NewApp(c)
 	if err != nil {
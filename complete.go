@@ -0,0 +1,264 @@
+package backcast
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/leedo/backcast/model"
+)
+
+// byteRange is a half-open range of offsets into a document.
+type byteRange struct {
+	start, end int64
+}
+
+// channelLayout locates the parts of a feed document the complete feed
+// replaces: the items, the channel elements that would send subscribers
+// back to the original feed, and where items go if there are none.
+type channelLayout struct {
+	items  []byteRange
+	drop   []byteRange
+	insert int64
+}
+
+func layoutChannel(body []byte) (channelLayout, error) {
+	var (
+		l     channelLayout
+		stack []string
+	)
+
+	l.insert = -1
+	dec := newXMLDecoder(body)
+
+	for {
+		offset := dec.InputOffset()
+
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return l, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			parent := ""
+			if len(stack) > 0 {
+				parent = stack[len(stack)-1]
+			}
+
+			inChannel := parent == "channel" || parent == "feed" && len(stack) == 1
+			redirect := inChannel && (t.Name.Local == "new-feed-url" || t.Name.Local == "link" && attr(t, "rel") == "self")
+
+			if t.Name.Local == "item" || t.Name.Local == "entry" || redirect {
+				if err := dec.Skip(); err != nil {
+					return l, err
+				}
+				r := byteRange{offset, dec.InputOffset()}
+				if redirect {
+					l.drop = append(l.drop, r)
+				} else {
+					l.items = append(l.items, r)
+				}
+				continue
+			}
+
+			stack = append(stack, t.Name.Local)
+		case xml.EndElement:
+			if t.Name.Local == "channel" || t.Name.Local == "feed" && len(stack) == 1 {
+				l.insert = offset
+			}
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+
+	if len(l.items) > 0 {
+		l.insert = l.items[0].start
+	}
+
+	return l, nil
+}
+
+func attr(t xml.StartElement, name string) string {
+	for _, a := range t.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// spliceItems replaces the items of body with items, already serialized.
+func spliceItems(body []byte, l channelLayout, items []byte) []byte {
+	cuts := append(append([]byteRange{}, l.items...), l.drop...)
+	if len(l.items) == 0 {
+		cuts = append(cuts, byteRange{l.insert, l.insert})
+	}
+	sort.Slice(cuts, func(i, j int) bool { return cuts[i].start < cuts[j].start })
+
+	var (
+		out bytes.Buffer
+		pos int64
+	)
+
+	for _, c := range cuts {
+		out.Write(body[pos:c.start])
+		if c.start == l.insert {
+			out.Write(items)
+		}
+		pos = c.end
+	}
+	out.Write(body[pos:])
+
+	return out.Bytes()
+}
+
+// sortItems puts the newest items first, by pubDate or, for items without
+// one, by when they were first seen.
+func sortItems(items []model.Item) {
+	date := func(i model.Item) time.Time {
+		if i.Published != nil {
+			return *i.Published
+		}
+		return i.FirstSeen
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return date(items[i]).After(date(items[j]))
+	})
+}
+
+// serializeItems writes each item as it last appeared when that was in a
+// document of the same format, and as a generated RSS item or Atom entry
+// otherwise, so a feed that switched formats keeps its current one. It
+// fails for any other format.
+func serializeItems(format string, items []model.Item) ([]byte, bool) {
+	var out bytes.Buffer
+
+	for _, i := range items {
+		if i.Raw != "" && i.Format == format {
+			out.WriteString("\n")
+			out.WriteString(i.Raw)
+			continue
+		}
+
+		var v interface{}
+		switch format {
+		case "rss":
+			r := newRSSItem(i)
+			r.DC, r.ContentNS = dcNamespace, contentNamespace
+			v = r
+		case "feed":
+			v = newAtomEntry(i)
+		default:
+			return nil, false
+		}
+
+		b, err := xml.Marshal(v)
+		if err != nil {
+			return nil, false
+		}
+		out.WriteString("\n")
+		out.Write(b)
+	}
+
+	out.WriteString("\n")
+	return out.Bytes(), true
+}
+
+// completeRSSHandler serves the latest channel with every item the feed
+// has ever listed, each in its latest version and newest first. The
+// channel keeps everything but what would move subscribers back to the
+// original feed, so podcast apps can subscribe to the back catalog.
+func (a *App) completeRSSHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	defer tx.Rollback()
+
+	feed, err := model.GetFeed(ctx, ps.ByName("id"), tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	ch, _, err := feed.CurrentChannel(ctx, tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	items, err := feed.AllItems(ctx, tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	sortItems(items)
+
+	generated := rssChannel{
+		Title:       firstNonEmpty(ch.Title, feed.URL),
+		Link:        firstNonEmpty(ch.Link, feed.URL),
+		Description: ch.Description,
+		Language:    ch.Language,
+	}
+
+	if ch.Revision == 0 || ch.Format == "RDF" {
+		writeRSS(w, generated, items)
+		return
+	}
+
+	rv, err := feed.GetRevision(ctx, strconv.FormatInt(ch.Revision, 10), tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	text, err := feed.BuildFeed(ctx, rv.Checksum, tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	body := []byte(text)
+
+	l, err := layoutChannel(body)
+	if err != nil || l.insert < 0 {
+		writeRSS(w, generated, items)
+		return
+	}
+
+	serialized, ok := serializeItems(ch.Format, items)
+	if !ok {
+		writeRSS(w, generated, items)
+		return
+	}
+
+	body = spliceItems(body, l, serialized)
+	if rv.Transcoded {
+		if raw, err := encodeCharset(rv.Charset, string(body)); err == nil {
+			body = raw
+		}
+	}
+
+	contentType := rv.ContentType
+	if contentType == "" {
+		contentType = "application/rss+xml"
+	}
+
+	w.Header().Add("Content-Type", contentType)
+	w.Header().Add("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
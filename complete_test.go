@@ -0,0 +1,111 @@
+package backcast
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// completeFeed archives each body in turn and returns complete.rss parsed.
+func completeFeed(t *testing.T, bodies ...string) parsedFeed {
+	t.Helper()
+
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	a := newTestApp(t, Config{})
+	f := addTestFeed(t, a, srv.URL+"/feed.xml")
+
+	for _, body = range bodies {
+		if _, ok, err := a.updateFeed(context.Background(), reloadFeed(t, a, f)); !ok || err != nil {
+			t.Fatalf("update: %v %v", ok, err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	a.routes().ServeHTTP(rec, httptest.NewRequest("GET", "/api/feed/"+strconv.FormatInt(f.ID, 10)+"/complete.rss", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("complete.rss answered %d: %s", rec.Code, rec.Body)
+	}
+
+	p, err := parseFeed(rec.Body.Bytes())
+	if err != nil {
+		t.Fatalf("complete.rss does not parse: %v\n%s", err, rec.Body)
+	}
+
+	return p
+}
+
+func itemKeys(items []feedItem) []string {
+	var keys []string
+	for _, i := range items {
+		keys = append(keys, i.key())
+	}
+	return keys
+}
+
+func equalKeys(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestCompleteRSS checks an item listed in several revisions appears once
+// in its latest version, and that items are newest first, with an undated
+// item placed by when it was first seen.
+func TestCompleteRSS(t *testing.T) {
+	p := completeFeed(t,
+		`<rss version="2.0"><channel><title>Show</title>
+<item><guid>a</guid><title>A</title><pubDate>Mon, 01 Jan 2024 00:00:00 +0000</pubDate></item>
+<item><guid>b</guid><title>B</title><pubDate>Tue, 02 Jan 2024 00:00:00 +0000</pubDate></item>
+</channel></rss>`,
+		`<rss version="2.0"><channel><title>Show</title>
+<item><guid>c</guid><title>C</title></item>
+<item><guid>b</guid><title>B, edited</title><pubDate>Tue, 02 Jan 2024 00:00:00 +0000</pubDate></item>
+</channel></rss>`)
+
+	if p.Format != "rss" || p.Channel.Title != "Show" {
+		t.Errorf("complete feed is %s titled %q, want the rss channel", p.Format, p.Channel.Title)
+	}
+
+	if keys := itemKeys(p.Items); !equalKeys(keys, []string{"c", "b", "a"}) {
+		t.Fatalf("complete feed lists %q, want c, b, a", keys)
+	}
+	if p.Items[1].Title != "B, edited" {
+		t.Errorf("item b is titled %q, want its latest version", p.Items[1].Title)
+	}
+}
+
+// TestCompleteRSSAtom checks a feed that moved from RSS to Atom is served
+// as Atom, with the items only seen as RSS written as entries.
+func TestCompleteRSSAtom(t *testing.T) {
+	p := completeFeed(t,
+		`<rss version="2.0"><channel><title>Blog</title>
+<item><guid>urn:old</guid><title>Old</title><link>http://example.com/old</link><pubDate>Mon, 01 Jan 2024 00:00:00 +0000</pubDate></item>
+</channel></rss>`,
+		`<feed xmlns="http://www.w3.org/2005/Atom"><title>Blog</title>
+<entry><id>urn:new</id><title>New</title><published>2024-02-01T00:00:00Z</published><updated>2024-02-01T00:00:00Z</updated></entry>
+</feed>`)
+
+	if p.Format != "feed" {
+		t.Fatalf("complete feed of an Atom feed is %s", p.Format)
+	}
+
+	if keys := itemKeys(p.Items); !equalKeys(keys, []string{"urn:new", "urn:old"}) {
+		t.Fatalf("complete feed lists %q, want urn:new, urn:old", keys)
+	}
+	if old := p.Items[1]; old.Title != "Old" || old.Link != "http://example.com/old" {
+		t.Errorf("entry generated from an rss item is %+v", old)
+	}
+}
@@ -1,6 +1,58 @@
 package backcast
 
+import "time"
+
 type Config struct {
-	File   string
-	Listen string
+	File             string
+	Listen           string
+	UserAgent        string
+	Proxy            string
+	ConnectTimeout   time.Duration
+	ReadTimeout      time.Duration
+	MaxBodySize      int64
+	HostRate         float64
+	HostBurst        int
+	HostConns        int
+	Workers          int
+	BatchSize        int
+	ScanInterval     time.Duration
+	MinInterval      time.Duration
+	MaxInterval      time.Duration
+	IgnoreHints      bool
+	MaxFailures      int
+	ConfirmFeedMoves bool
+	SecretKeyFile    string
+	RespectRobots    bool
+	Transcode        bool
+	PublicURL        string
+	WebSubLease      time.Duration
+	FileRoots        []string
+	Commands         map[string][]string
+	InstanceID       string
+	LeaseDuration    time.Duration
+}
+
+// withDefaults fills in the settings that have no useful zero value with
+// the defaults of the command line flags, so an embedder can leave them
+// out. Zero timeouts, limits and rates still mean unlimited.
+func (c Config) withDefaults() Config {
+	if c.Workers <= 0 {
+		c.Workers = 4
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = 100
+	}
+	if c.ScanInterval <= 0 {
+		c.ScanInterval = 1 * time.Minute
+	}
+	if c.MinInterval <= 0 {
+		c.MinInterval = 15 * time.Minute
+	}
+	if c.MaxInterval <= 0 {
+		c.MaxInterval = 24 * time.Hour
+	}
+	if c.LeaseDuration <= 0 {
+		c.LeaseDuration = 10 * time.Minute
+	}
+	return c
 }
@@ -0,0 +1,458 @@
+package backcast
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/leedo/backcast/model"
+	"golang.org/x/net/publicsuffix"
+)
+
+// cookieJar is the jar for one fetch. The stored cookies of the feed's
+// site are read before the fetch and what the servers set is kept in
+// memory until saveCookies, so the HTTP client never touches the
+// database. A redirect to another site is only sent cookies set during
+// the fetch.
+type cookieJar struct {
+	mu      sync.Mutex
+	cookies map[string]model.Cookie
+	changed map[string]bool
+}
+
+// loadCookieJar reads the stored cookies for the site of host.
+func loadCookieJar(ctx context.Context, host string, tx *sql.Tx) (*cookieJar, error) {
+	j := &cookieJar{
+		cookies: make(map[string]model.Cookie),
+		changed: make(map[string]bool),
+	}
+
+	cookies, err := model.GetSiteCookies(ctx, cookieSite(host), tx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range cookies {
+		j.cookies[cookieKey(c)] = c
+	}
+
+	return j, nil
+}
+
+func cookieKey(c model.Cookie) string {
+	return c.Domain + ";" + c.Path + ";" + c.Name
+}
+
+// cookieSite is the registrable domain of host, the widest domain a cookie
+// sent to host can have been set for.
+func cookieSite(host string) string {
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	if site, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return site
+	}
+	return host
+}
+
+func isPublicSuffix(domain string) bool {
+	suffix, _ := publicsuffix.PublicSuffix(domain)
+	return suffix == domain
+}
+
+func domainMatch(host, domain string) bool {
+	if host == domain {
+		return true
+	}
+	return net.ParseIP(host) == nil && strings.HasSuffix(host, "."+domain)
+}
+
+func pathMatch(path, cookiePath string) bool {
+	if path == "" {
+		path = "/"
+	}
+	if path == cookiePath {
+		return true
+	}
+	if !strings.HasPrefix(path, cookiePath) {
+		return false
+	}
+	return strings.HasSuffix(cookiePath, "/") || path[len(cookiePath)] == '/'
+}
+
+func cookieApplies(c model.Cookie, u *url.URL, now time.Time) bool {
+	host := strings.ToLower(u.Hostname())
+	switch {
+	case c.Expired(now):
+		return false
+	case c.HostOnly && c.Domain != host:
+		return false
+	case !domainMatch(host, c.Domain):
+		return false
+	case c.Secure && u.Scheme != "https":
+		return false
+	}
+	return pathMatch(u.Path, c.Path)
+}
+
+func (j *cookieJar) Cookies(u *url.URL) []*http.Cookie {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+
+	var matched []model.Cookie
+	for _, c := range j.cookies {
+		if cookieApplies(c, u, now) {
+			matched = append(matched, c)
+		}
+	}
+
+	// the most specific path goes first
+	sort.Slice(matched, func(i, k int) bool {
+		if len(matched[i].Path) != len(matched[k].Path) {
+			return len(matched[i].Path) > len(matched[k].Path)
+		}
+		return matched[i].Name < matched[k].Name
+	})
+
+	cookies := make([]*http.Cookie, len(matched))
+	for i, c := range matched {
+		cookies[i] = &http.Cookie{Name: c.Name, Value: c.Value}
+	}
+
+	return cookies
+}
+
+func (j *cookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	for _, hc := range cookies {
+		c, err := newCookie(u, hc, now)
+		if err != nil {
+			log.Printf("ignoring cookie %s from %s: %v", hc.Name, u.Host, err)
+			continue
+		}
+		k := cookieKey(c)
+		j.cookies[k] = c
+		j.changed[k] = true
+	}
+}
+
+// newCookie checks a cookie set by u the way a browser would. A Domain
+// attribute naming a public suffix is refused, unless it is the host
+// itself, which then gets a host-only cookie.
+func newCookie(u *url.URL, hc *http.Cookie, now time.Time) (model.Cookie, error) {
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return model.Cookie{}, fmt.Errorf("%s has no host", u)
+	}
+
+	if hc.Name == "" || (&http.Cookie{Name: hc.Name}).String() == "" {
+		return model.Cookie{}, fmt.Errorf("invalid cookie name %q", hc.Name)
+	}
+
+	c := model.Cookie{
+		Name:     hc.Name,
+		Value:    hc.Value,
+		Path:     hc.Path,
+		Secure:   hc.Secure,
+		HTTPOnly: hc.HttpOnly,
+	}
+
+	domain := strings.TrimPrefix(strings.ToLower(hc.Domain), ".")
+	switch {
+	case domain == "" || domain == host:
+		c.Domain, c.HostOnly = host, domain == "" || net.ParseIP(host) != nil || isPublicSuffix(host)
+	case !domainMatch(host, domain):
+		return c, fmt.Errorf("domain %s does not match %s", domain, host)
+	case isPublicSuffix(domain):
+		return c, fmt.Errorf("domain %s is a public suffix", domain)
+	default:
+		c.Domain = domain
+	}
+
+	if !strings.HasPrefix(c.Path, "/") {
+		c.Path = "/"
+		if i := strings.LastIndexByte(u.Path, '/'); i > 0 {
+			c.Path = u.Path[:i]
+		}
+	}
+
+	switch {
+	case hc.MaxAge < 0:
+		expired := now
+		c.Expires = &expired
+	case hc.MaxAge > 0:
+		expires := now.Add(time.Duration(hc.MaxAge) * time.Second)
+		c.Expires = &expires
+	case !hc.Expires.IsZero():
+		expires := hc.Expires
+		c.Expires = &expires
+	}
+
+	return c, nil
+}
+
+// saveCookies stores the cookies set during a fetch, deleting the ones the
+// servers expired. Session cookies are kept until they are replaced.
+func (a *App) saveCookies(ctx context.Context, j *cookieJar) error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	var changed []model.Cookie
+	for k := range j.changed {
+		changed = append(changed, j.cookies[k])
+	}
+	j.mu.Unlock()
+
+	if len(changed) == 0 {
+		return nil
+	}
+
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	now := time.Now()
+	for _, c := range changed {
+		if c.Expired(now) {
+			err = model.DeleteCookie(ctx, c, tx)
+		} else {
+			err = model.SetCookie(ctx, c, tx)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := model.PruneCookies(ctx, now, tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// forgotten only once stored, so a failed save leaves them pending
+	j.mu.Lock()
+	for _, c := range changed {
+		delete(j.changed, cookieKey(c))
+	}
+	j.mu.Unlock()
+
+	return nil
+}
+
+// cookieSeed is a cookie set through the API, usually copied from a
+// browser that got past the consent page.
+type cookieSeed struct {
+	Name     string     `json:"name"`
+	Value    string     `json:"value"`
+	Domain   string     `json:"domain"`
+	Path     string     `json:"path"`
+	Expires  *time.Time `json:"expires"`
+	Secure   bool       `json:"secure"`
+	HTTPOnly bool       `json:"http_only"`
+}
+
+func (s cookieSeed) cookie() *http.Cookie {
+	hc := &http.Cookie{
+		Name:     s.Name,
+		Value:    s.Value,
+		Domain:   s.Domain,
+		Path:     s.Path,
+		Secure:   s.Secure,
+		HttpOnly: s.HTTPOnly,
+	}
+	if s.Expires != nil {
+		hc.Expires = *s.Expires
+	}
+	if hc.Path == "" {
+		hc.Path = "/"
+	}
+	return hc
+}
+
+// feedCookies lists the stored cookies that would be sent to the feed.
+func feedCookies(ctx context.Context, f model.Feed, tx *sql.Tx) ([]model.Cookie, error) {
+	u, err := url.Parse(f.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := model.GetCookies(ctx, model.CookieDomains(feedHost(f.URL)), tx)
+	if err != nil {
+		return nil, err
+	}
+
+	// every path on the host, not just the feed's own
+	u.Path = ""
+	now := time.Now()
+
+	cookies := []model.Cookie{}
+	for _, c := range stored {
+		p := c.Path
+		c.Path = "/"
+		if cookieApplies(c, u, now) {
+			c.Path = p
+			cookies = append(cookies, c)
+		}
+	}
+
+	return cookies, nil
+}
+
+func (a *App) feedCookiesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	defer tx.Rollback()
+
+	feed, err := model.GetFeed(ctx, ps.ByName("id"), tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	cookies, err := feedCookies(ctx, feed, tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(cookies); err != nil {
+		jsonError(err, w)
+		return
+	}
+}
+
+// updateFeedCookiesHandler adds cookies to the jar as if the feed's server
+// had set them, and returns the cookies the feed will now be sent.
+func (a *App) updateFeedCookiesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+
+	var seeds []cookieSeed
+
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&seeds); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	defer tx.Rollback()
+
+	feed, err := model.GetFeed(ctx, ps.ByName("id"), tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	u, err := url.Parse(feed.URL)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	now := time.Now()
+	for _, s := range seeds {
+		c, err := newCookie(u, s.cookie(), now)
+		if err != nil {
+			jsonError(err, w)
+			return
+		}
+		if err := model.SetCookie(ctx, c, tx); err != nil {
+			jsonError(err, w)
+			return
+		}
+	}
+
+	cookies, err := feedCookies(ctx, feed, tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(cookies); err != nil {
+		jsonError(err, w)
+		return
+	}
+}
+
+// deleteFeedCookiesHandler clears every cookie that would be sent to the
+// feed's host, including those shared with other hosts on its domain.
+func (a *App) deleteFeedCookiesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	defer tx.Rollback()
+
+	feed, err := model.GetFeed(ctx, ps.ByName("id"), tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if host := feedHost(feed.URL); host != "" {
+		if err := model.DeleteCookies(ctx, host, tx); err != nil {
+			jsonError(err, w)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	fmt.Fprint(w, `{"status":"ok"}`)
+}
@@ -0,0 +1,152 @@
+package backcast
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leedo/backcast/model"
+)
+
+func TestNewCookieDomain(t *testing.T) {
+	for _, c := range []struct {
+		url, domain string
+		want        string
+		hostOnly    bool
+	}{
+		{"https://www.example.co.uk/feed", "", "www.example.co.uk", true},
+		{"https://www.example.co.uk/feed", "example.co.uk", "example.co.uk", false},
+		{"https://www.example.co.uk/feed", ".example.co.uk", "example.co.uk", false},
+		{"https://www.example.co.uk/feed", "co.uk", "", false},
+		{"https://www.example.co.uk/feed", "uk", "", false},
+		{"https://www.example.co.uk/feed", "other.co.uk", "", false},
+		{"https://someone.github.io/feed", "github.io", "", false},
+		{"https://someone.github.io/feed", "someone.github.io", "someone.github.io", false},
+		// a host that is itself a public suffix only gets host-only cookies
+		{"https://github.io/feed", "github.io", "github.io", true},
+		{"http://localhost/feed", "localhost", "localhost", true},
+		{"http://127.0.0.1/feed", "127.0.0.1", "127.0.0.1", true},
+	} {
+		u, _ := url.Parse(c.url)
+		got, err := newCookie(u, &http.Cookie{Name: "consent", Value: "yes", Domain: c.domain}, time.Now())
+
+		switch {
+		case c.want == "" && err == nil:
+			t.Errorf("%s accepted a cookie for domain %q as %q", c.url, c.domain, got.Domain)
+		case c.want != "" && err != nil:
+			t.Errorf("%s refused a cookie for domain %q: %v", c.url, c.domain, err)
+		case c.want != "" && (got.Domain != c.want || got.HostOnly != c.hostOnly):
+			t.Errorf("%s set a cookie for domain %q as %q host-only %v, want %q host-only %v", c.url, c.domain, got.Domain, got.HostOnly, c.want, c.hostOnly)
+		}
+	}
+}
+
+// TestCookieJar checks a consent cookie set by one fetch is sent with
+// the next, and that the jar only carries the cookies of the feed's site.
+func TestCookieJar(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received []string
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		received = append(received, r.Header.Get("Cookie"))
+		mu.Unlock()
+
+		http.SetCookie(w, &http.Cookie{Name: "consent", Value: "yes", Path: "/"})
+		w.Write([]byte(testFeed))
+	}))
+	defer srv.Close()
+
+	a := newTestApp(t, Config{})
+	f := addTestFeed(t, a, srv.URL+"/feed.xml")
+	ctx := context.Background()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetFetchOptions(ctx, model.FetchOptions{Cookies: true}, tx); err != nil {
+		t.Fatal(err)
+	}
+	// a cookie of another site is never loaded into the feed's jar
+	if err := model.SetCookie(ctx, model.Cookie{Domain: "example.com", Path: "/", Name: "other", Value: "x"}, tx); err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := a.updateFeed(ctx, reloadFeed(t, a, f)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(received) != 2 || received[0] != "" || received[1] != "consent=yes" {
+		t.Errorf("server received cookies %q, want none and then consent=yes", received)
+	}
+
+	tx, err = a.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	jar, err := loadCookieJar(ctx, feedHost(f.URL), tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jar.cookies) != 1 {
+		t.Errorf("jar for %s loaded %d cookies, want only its own", feedHost(f.URL), len(jar.cookies))
+	}
+}
+
+// TestSaveCookiesTakesWriteLock checks cookies set during a fetch are
+// stored through the write lock, so a concurrent commit cannot make the
+// save fail and lose them.
+func TestSaveCookiesTakesWriteLock(t *testing.T) {
+	a := newTestApp(t, Config{})
+	ctx := context.Background()
+
+	jar := &cookieJar{cookies: make(map[string]model.Cookie), changed: make(map[string]bool)}
+	u, _ := url.Parse("http://example.com/feed.xml")
+	jar.SetCookies(u, []*http.Cookie{{Name: "consent", Value: "yes", Path: "/"}})
+
+	a.writeLock.Lock()
+
+	done := make(chan error)
+	go func() {
+		done <- a.saveCookies(ctx, jar)
+	}()
+
+	select {
+	case err := <-done:
+		a.writeLock.Unlock()
+		t.Fatalf("cookies saved while the write lock was held: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	a.writeLock.Unlock()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	stored, err := loadCookieJar(ctx, "example.com", tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.cookies) != 1 || len(jar.changed) != 0 {
+		t.Errorf("stored %d cookies with %d left pending, want 1 and none", len(stored.cookies), len(jar.changed))
+	}
+}
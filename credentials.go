@@ -0,0 +1,206 @@
+package backcast
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	credentialsBasic   = "basic"
+	credentialsBearer  = "bearer"
+	credentialsHeaders = "headers"
+)
+
+var errNoSecretKey = errors.New("no server secret key configured")
+
+type credentials struct {
+	Kind     string            `json:"kind"`
+	Username string            `json:"username,omitempty"`
+	Password string            `json:"password,omitempty"`
+	Token    string            `json:"token,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+}
+
+func (c credentials) validate() error {
+	switch c.Kind {
+	case credentialsBasic:
+		if c.Username == "" {
+			return fmt.Errorf("basic credentials need a username")
+		}
+	case credentialsBearer:
+		if c.Token == "" {
+			return fmt.Errorf("bearer credentials need a token")
+		}
+	case credentialsHeaders:
+		if len(c.Headers) == 0 {
+			return fmt.Errorf("header credentials need at least one header")
+		}
+	default:
+		return fmt.Errorf("unknown credentials kind %q", c.Kind)
+	}
+	return nil
+}
+
+func (c credentials) apply(req *http.Request) {
+	switch c.Kind {
+	case credentialsBasic:
+		req.SetBasicAuth(c.Username, c.Password)
+	case credentialsBearer:
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	case credentialsHeaders:
+		for k, v := range c.Headers {
+			req.Header.Set(k, v)
+		}
+	}
+}
+
+func (c credentials) secrets() []string {
+	var s []string
+	switch c.Kind {
+	case credentialsBasic:
+		s = append(s, c.Password, base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password)))
+	case credentialsBearer:
+		s = append(s, c.Token)
+	case credentialsHeaders:
+		for _, v := range c.Headers {
+			s = append(s, v)
+		}
+	}
+	return s
+}
+
+// redactedError hides credentials in the message of an error while
+// keeping the original error available for classification.
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e redactedError) Error() string {
+	return e.msg
+}
+
+func (e redactedError) Unwrap() error {
+	return e.err
+}
+
+func (c *credentials) redact(err error) error {
+	if c == nil || err == nil {
+		return err
+	}
+
+	msg := err.Error()
+	for _, s := range c.secrets() {
+		if s != "" {
+			msg = strings.Replace(msg, s, "[REDACTED]", -1)
+		}
+	}
+
+	return redactedError{msg, err}
+}
+
+type sealer struct {
+	aead cipher.AEAD
+}
+
+// loadSecretKey reads a 32 byte AES key, hex or base64 encoded, from path.
+func loadSecretKey(path string) (*sealer, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	text := strings.TrimSpace(string(b))
+	key, err := hex.DecodeString(text)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(text)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("secret key in %s must be 32 bytes, hex or base64 encoded", path)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sealer{aead}, nil
+}
+
+// sealContext is the associated data that binds a sealed value to what
+// it protects, so a value copied into another row does not open there.
+func sealContext(purpose, owner string) []byte {
+	return []byte(purpose + "\x00" + owner)
+}
+
+func (s *sealer) seal(plaintext, associated []byte) ([]byte, error) {
+	if s == nil {
+		return nil, errNoSecretKey
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return s.aead.Seal(nonce, nonce, plaintext, associated), nil
+}
+
+func (s *sealer) open(data, associated []byte) ([]byte, error) {
+	if s == nil {
+		return nil, errNoSecretKey
+	}
+
+	n := s.aead.NonceSize()
+	if len(data) < n {
+		return nil, fmt.Errorf("sealed data is too short")
+	}
+
+	return s.aead.Open(nil, data[:n], data[n:], associated)
+}
+
+func credentialsContext(feed int64) []byte {
+	return sealContext("credentials", strconv.FormatInt(feed, 10))
+}
+
+func (s *sealer) sealCredentials(c credentials, feed int64) ([]byte, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	return s.seal(b, credentialsContext(feed))
+}
+
+func (s *sealer) openCredentials(data []byte, feed int64) (*credentials, error) {
+	b, err := s.open(data, credentialsContext(feed))
+	if err != nil {
+		return nil, err
+	}
+
+	var c credentials
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
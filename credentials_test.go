@@ -0,0 +1,55 @@
+package backcast
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKeyFile(t *testing.T) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "key")
+	if err := ioutil.WriteFile(path, []byte(strings.Repeat("ab", 32)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func newTestSealer(t *testing.T) *sealer {
+	t.Helper()
+
+	s, err := loadSecretKey(testKeyFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestSealedCredentialsAreBoundToFeed(t *testing.T) {
+	s := newTestSealer(t)
+
+	data, err := s.sealCredentials(credentials{Kind: credentialsBearer, Token: "secret"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := s.openCredentials(data, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Token != "secret" {
+		t.Errorf("token = %q after a round trip", c.Token)
+	}
+
+	if _, err := s.openCredentials(data, 2); err == nil {
+		t.Error("credentials sealed for feed 1 opened for feed 2")
+	}
+
+	if _, err := s.open(data, tlsKeyContext("feed", "1")); err == nil {
+		t.Error("credentials opened as a TLS key")
+	}
+}
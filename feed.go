@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/leedo/backcast/model"
@@ -14,11 +16,46 @@ type jsonErr struct {
 }
 
 func (a *App) updateFeedHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	wait, err := jobWait(r)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	job, ok := a.queueRefresh(w, r, ps)
+	if !ok {
+		return
+	}
+
+	if job, err = a.waitJob(r, job, wait); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	out := struct {
+		Status string    `json:"status"`
+		Job    model.Job `json:"job"`
+	}{"ok", job}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(out); err != nil {
+		jsonError(err, w)
+		return
+	}
+}
+
+// queueRefresh records a manual refresh of the feed in the route. The write
+// lock is let go before the caller waits on the job, which needs it to run.
+func (a *App) queueRefresh(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (model.Job, bool) {
 	ctx := r.Context()
-	tx, err := a.db.Begin()
+
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	tx, err := a.beginWrite()
 	if err != nil {
 		jsonInternalError(err, w)
-		return
+		return model.Job{}, false
 	}
 
 	defer tx.Rollback()
@@ -26,15 +63,29 @@ func (a *App) updateFeedHandler(w http.ResponseWriter, r *http.Request, ps httpr
 	feed, err := model.GetFeed(ctx, ps.ByName("id"), tx)
 	if err != nil {
 		jsonError(err, w)
-		return
+		return model.Job{}, false
 	}
 
-	a.refresh <- feed
-	fmt.Fprint(w, `{"status":"ok"}`)
+	job, err := a.enqueueJob(ctx, feed, model.PriorityManual, "manual", tx)
+	if err != nil {
+		jsonInternalError(err, w)
+		return model.Job{}, false
+	}
+
+	if err := tx.Commit(); err != nil {
+		jsonInternalError(err, w)
+		return model.Job{}, false
+	}
+
+	return job, true
 }
 
 func (a *App) createFeedHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	ctx := r.Context()
+	wait, err := jobWait(r)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
 
 	var f model.Feed
 
@@ -44,21 +95,213 @@ func (a *App) createFeedHandler(w http.ResponseWriter, r *http.Request, ps httpr
 		return
 	}
 
+	if _, _, err := a.source(f.URL); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	feed, job, ok := a.addFeed(w, r, f.URL)
+	if !ok {
+		return
+	}
+
+	if job, err = a.waitJob(r, job, wait); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	// the job is reported next to the feed fields so existing clients
+	// see the same object as before
+	out := struct {
+		model.Feed
+		Job model.Job `json:"job"`
+	}{feed, job}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(out); err != nil {
+		jsonError(err, w)
+		return
+	}
+}
+
+// addFeed creates a feed and queues its first fetch. A feed that already
+// exists is written out as is, and like an error ends the request.
+func (a *App) addFeed(w http.ResponseWriter, r *http.Request, url string) (model.Feed, model.Job, bool) {
+	ctx := r.Context()
+
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		jsonInternalError(err, w)
+		return model.Feed{}, model.Job{}, false
+	}
+
+	defer tx.Rollback()
+
+	if feed, err := model.GetFeedByURL(ctx, url, tx); err == nil {
+		enc := json.NewEncoder(w)
+		if err := enc.Encode(feed); err != nil {
+			jsonError(err, w)
+		}
+		return feed, model.Job{}, false
+	}
+
+	feed, err := model.CreateFeed(ctx, url, tx)
+	if err != nil {
+		jsonError(err, w)
+		return feed, model.Job{}, false
+	}
+
+	job, err := a.enqueueJob(ctx, feed, model.PriorityCreated, "created", tx)
+	if err != nil {
+		jsonInternalError(err, w)
+		return feed, job, false
+	}
+
+	if err := tx.Commit(); err != nil {
+		jsonInternalError(err, w)
+		return feed, job, false
+	}
+
+	return feed, job, true
+}
+
+func (a *App) feedOptionsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+
 	tx, err := a.db.Begin()
 	if err != nil {
 		jsonInternalError(err, w)
 		return
 	}
 
-	feed, err := model.CreateFeed(ctx, f.URL, tx)
+	defer tx.Rollback()
+
+	feed, err := model.GetFeed(ctx, ps.ByName("id"), tx)
 	if err != nil {
 		jsonError(err, w)
 		return
 	}
 
-	tx.Commit()
+	o, err := feed.GetFetchOptions(ctx, tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
 
-	a.refresh <- feed
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(o); err != nil {
+		jsonError(err, w)
+		return
+	}
+}
+
+func (a *App) updateFeedOptionsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+
+	var o model.FetchOptions
+
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&o); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if o.Proxy != "" {
+		if _, err := a.fetcher.transport(o.Proxy, nil); err != nil {
+			jsonError(err, w)
+			return
+		}
+	}
+
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	defer tx.Rollback()
+
+	feed, err := model.GetFeed(ctx, ps.ByName("id"), tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if err := feed.SetFetchOptions(ctx, o, tx); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(o); err != nil {
+		jsonError(err, w)
+		return
+	}
+}
+
+func (a *App) updateFeedScheduleHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+
+	var sc model.Schedule
+
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&sc); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if sc.MinInterval < 0 || sc.MaxInterval < 0 || (sc.MaxInterval > 0 && sc.MaxInterval < sc.MinInterval) {
+		jsonError(fmt.Errorf("invalid interval bounds"), w)
+		return
+	}
+
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	defer tx.Rollback()
+
+	feed, err := model.GetFeed(ctx, ps.ByName("id"), tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if err := feed.SetScheduleOptions(ctx, sc, tx); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	feed.Schedule.MinInterval = sc.MinInterval
+	feed.Schedule.MaxInterval = sc.MaxInterval
+	feed.Schedule.IgnoreHints = sc.IgnoreHints
+	feed.Schedule = a.reboundSchedule(feed, time.Now())
+
+	if err := feed.UpdateSchedule(ctx, feed.Schedule, tx); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		jsonInternalError(err, w)
+		return
+	}
 
 	enc := json.NewEncoder(w)
 	if err := enc.Encode(feed); err != nil {
@@ -67,6 +310,131 @@ func (a *App) createFeedHandler(w http.ResponseWriter, r *http.Request, ps httpr
 	}
 }
 
+func (a *App) feedCredentialsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	defer tx.Rollback()
+
+	feed, err := model.GetFeed(ctx, ps.ByName("id"), tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	c, err := feed.GetCredentials(ctx, tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(c); err != nil {
+		jsonError(err, w)
+		return
+	}
+}
+
+func (a *App) updateFeedCredentialsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+
+	var c credentials
+
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&c); err != nil {
+		jsonError(fmt.Errorf("invalid credentials"), w)
+		return
+	}
+
+	if err := c.validate(); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	defer tx.Rollback()
+
+	feed, err := model.GetFeed(ctx, ps.ByName("id"), tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	data, err := a.sealer.sealCredentials(c, feed.ID)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if err := feed.SetCredentials(ctx, c.Kind, data, tx); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	stored, err := feed.GetCredentials(ctx, tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(stored); err != nil {
+		jsonError(err, w)
+		return
+	}
+}
+
+func (a *App) deleteFeedCredentialsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	defer tx.Rollback()
+
+	feed, err := model.GetFeed(ctx, ps.ByName("id"), tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if err := feed.DeleteCredentials(ctx, tx); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	fmt.Fprint(w, `{"status":"ok"}`)
+}
+
 func (a *App) feedHistoryHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	ctx := r.Context()
 
@@ -118,21 +486,20 @@ func (a *App) feedRSSHandler(w http.ResponseWriter, r *http.Request, ps httprout
 		return
 	}
 
-	w.Header().Add("Content-Type", rv.ContentType)
-	w.Header().Add("Content-Length", rv.ContentLength)
-
-	if rv.Etag != "" {
-		w.Header().Add("Etag", rv.Etag)
-	} else {
-		w.Header().Add("Etag", rv.Checksum)
-	}
-
 	rss, err := f.BuildFeed(ctx, "", tx)
 	if err != nil {
 		jsonError(err, w)
+		return
 	}
 
-	fmt.Fprint(w, rss)
+	if rawRequested(r) {
+		if rss, err = model.RawBody(rv, rss); err != nil {
+			jsonError(err, w)
+			return
+		}
+	}
+
+	writeRevision(w, rv, rss)
 }
 
 func (a *App) feedRevisionRSSHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -157,8 +524,34 @@ func (a *App) feedRevisionRSSHandler(w http.ResponseWriter, r *http.Request, ps
 		return
 	}
 
+	rss, err := f.BuildFeed(ctx, rv.Checksum, tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if rawRequested(r) {
+		if rss, err = model.RawBody(rv, rss); err != nil {
+			jsonError(err, w)
+			return
+		}
+	}
+
+	writeRevision(w, rv, rss)
+}
+
+// writeRevision serves a revision in the encoding it was fetched in, so a
+// transcoded feed is returned byte for byte as the publisher sent it.
+func writeRevision(w http.ResponseWriter, rv model.Revision, rss string) {
+	body := []byte(rss)
+	if rv.Transcoded {
+		if raw, err := encodeCharset(rv.Charset, rss); err == nil {
+			body = raw
+		}
+	}
+
 	w.Header().Add("Content-Type", rv.ContentType)
-	w.Header().Add("Content-Length", rv.ContentLength)
+	w.Header().Add("Content-Length", strconv.Itoa(len(body)))
 
 	if rv.Etag != "" {
 		w.Header().Add("Etag", rv.Etag)
@@ -166,20 +559,90 @@ func (a *App) feedRevisionRSSHandler(w http.ResponseWriter, r *http.Request, ps
 		w.Header().Add("Etag", rv.Checksum)
 	}
 
-	rss, err := f.BuildFeed(ctx, ps.ByName("sha"), tx)
+	w.Write(body)
+}
+
+func (a *App) feedHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		jsonInternalError(err, w)
+	}
+
+	defer tx.Rollback()
+
+	feed, err := model.GetFeed(ctx, ps.ByName("id"), tx)
 	if err != nil {
 		jsonError(err, w)
+		return
 	}
 
-	fmt.Fprint(w, rss)
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(feed); err != nil {
+		jsonError(err, w)
+		return
+	}
 }
 
-func (a *App) feedHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+func (a *App) brokenFeedsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	ctx := r.Context()
 
 	tx, err := a.db.Begin()
 	if err != nil {
 		jsonInternalError(err, w)
+		return
+	}
+
+	defer tx.Rollback()
+
+	feeds, err := model.FindBrokenFeeds(ctx, tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(feeds); err != nil {
+		jsonError(err, w)
+		return
+	}
+}
+
+func (a *App) duplicateFeedsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	defer tx.Rollback()
+
+	groups, err := model.FindDuplicateFeeds(ctx, tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(groups); err != nil {
+		jsonError(err, w)
+		return
+	}
+}
+
+func (a *App) mergeFeedHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		jsonInternalError(err, w)
+		return
 	}
 
 	defer tx.Rollback()
@@ -190,6 +653,33 @@ func (a *App) feedHandler(w http.ResponseWriter, r *http.Request, ps httprouter.
 		return
 	}
 
+	other, err := model.GetFeed(ctx, ps.ByName("other"), tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if err := model.MergeFeeds(ctx, feed, other, tx); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if err := a.indexItems(ctx, feed, tx); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	feed, err = model.GetFeed(ctx, ps.ByName("id"), tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
 	enc := json.NewEncoder(w)
 	if err := enc.Encode(feed); err != nil {
 		jsonError(err, w)
@@ -0,0 +1,266 @@
+package backcast
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/leedo/backcast/model"
+)
+
+// FetchResponse is the result of fetching a feed from any Source.
+type FetchResponse struct {
+	StatusCode int
+	Status     string
+	Header     http.Header
+	Body       []byte
+
+	// PermanentURL is where the leading run of permanent redirects (301
+	// or 308) ended up, if the request was permanently redirected at all.
+	PermanentURL    string
+	PermanentStatus int
+}
+
+const maxRedirects = 10
+
+// feedSettings are the per-feed settings the fetcher applies to a request.
+type feedSettings struct {
+	Options     model.FetchOptions
+	Credentials *credentials
+	TLS         *tlsSettings
+	Cookies     *cookieJar
+}
+
+// bodyError marks failures to read or decode a response body, as opposed
+// to failures to reach the server at all.
+type bodyError struct {
+	err error
+}
+
+func (e bodyError) Error() string {
+	return e.err.Error()
+}
+
+func (e bodyError) Unwrap() error {
+	return e.err
+}
+
+// parseError marks a body that was fetched and archived but is not a
+// feed, like the HTML page a parked domain serves.
+type parseError struct {
+	err error
+}
+
+func (e parseError) Error() string {
+	return "not a feed: " + e.err.Error()
+}
+
+func (e parseError) Unwrap() error {
+	return e.err
+}
+
+type fetcher struct {
+	config     Config
+	mu         sync.Mutex
+	transports map[string]*http.Transport
+}
+
+func newFetcher(c Config) *fetcher {
+	return &fetcher{
+		config:     c,
+		transports: make(map[string]*http.Transport),
+	}
+}
+
+// transport returns a transport for the proxy and TLS settings, shared
+// with every other request using the same ones.
+func (fr *fetcher) transport(proxy string, ts *tlsSettings) (*http.Transport, error) {
+	key := proxy + " " + ts.fingerprint()
+
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	if t, ok := fr.transports[key]; ok {
+		return t, nil
+	}
+
+	dialer := &net.Dialer{Timeout: fr.config.ConnectTimeout}
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   fr.config.ConnectTimeout,
+		ResponseHeaderTimeout: fr.config.ReadTimeout,
+		DisableCompression:    true,
+		MaxIdleConnsPerHost:   2,
+	}
+
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %v", proxy, err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+
+	if ts != nil {
+		c, err := ts.config()
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig = c
+	}
+
+	fr.transports[key] = t
+	return t, nil
+}
+
+func (fr *fetcher) fetch(ctx context.Context, req *http.Request, s feedSettings) (*FetchResponse, error) {
+	res, err := fr.do(ctx, req, s)
+	return res, s.Credentials.redact(err)
+}
+
+func (fr *fetcher) do(ctx context.Context, req *http.Request, s feedSettings) (*FetchResponse, error) {
+	o := s.Options
+
+	proxy := fr.config.Proxy
+	if o.Proxy != "" {
+		proxy = o.Proxy
+	}
+
+	t, err := fr.transport(proxy, s.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.TLS != nil && s.TLS.Insecure && req.URL.Scheme == "https" {
+		log.Printf("WARNING: fetching %s without verifying its TLS certificate", req.URL)
+	}
+
+	timeout := fr.config.ReadTimeout
+	if o.Timeout > 0 {
+		timeout = o.TimeoutDuration()
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	userAgent := fr.config.UserAgent
+	if o.UserAgent != "" {
+		userAgent = o.UserAgent
+	}
+	if userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+
+	if s.Credentials != nil {
+		s.Credentials.apply(req)
+	}
+
+	var (
+		permanentURL    string
+		permanentStatus int
+		temporary       bool
+	)
+
+	client := &http.Client{
+		Transport: t,
+		CheckRedirect: func(next *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			// net/http already drops Authorization when leaving the
+			// original host, custom credential headers need the same
+			if s.Credentials != nil && next.URL.Host != via[0].URL.Host {
+				for k := range s.Credentials.Headers {
+					next.Header.Del(k)
+				}
+			}
+			switch next.Response.StatusCode {
+			case http.StatusMovedPermanently, http.StatusPermanentRedirect:
+				if !temporary {
+					permanentURL = next.URL.String()
+					permanentStatus = next.Response.StatusCode
+				}
+			default:
+				temporary = true
+			}
+			return nil
+		},
+	}
+
+	if s.Cookies != nil {
+		client.Jar = s.Cookies
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	res := &FetchResponse{
+		StatusCode:      resp.StatusCode,
+		Status:          resp.Status,
+		Header:          resp.Header,
+		PermanentURL:    permanentURL,
+		PermanentStatus: permanentStatus,
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return res, nil
+	}
+
+	body, err := decodeBody(resp)
+	if err != nil {
+		return nil, bodyError{err}
+	}
+
+	res.Body, err = readLimited(body, bodyLimit(fr.config, o))
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func decodeBody(resp *http.Response) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(resp.Body)
+	case "deflate":
+		// some servers send raw deflate data instead of the zlib format
+		// the spec asks for, so sniff the header before choosing
+		br := bufio.NewReader(resp.Body)
+		head, err := br.Peek(2)
+		if err != nil {
+			return nil, err
+		}
+		if head[0]&0x0f == 8 && (uint16(head[0])<<8|uint16(head[1]))%31 == 0 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+}
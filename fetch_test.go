@@ -0,0 +1,97 @@
+package backcast
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testFeed = `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>Test</title><link>http://example.com/</link>
+<item><title>First</title><guid>first</guid></item>
+</channel></rss>
+`
+
+func TestConditionalFetch(t *testing.T) {
+	const (
+		etag         = `"v1"`
+		lastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+	)
+
+	var (
+		mu       sync.Mutex
+		requests []http.Header
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Header.Clone())
+		mu.Unlock()
+
+		if r.Header.Get("If-None-Match") == etag || r.Header.Get("If-Modified-Since") == lastModified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/rss+xml")
+		w.Header().Set("Etag", etag)
+		w.Header().Set("Last-Modified", lastModified)
+		w.Write([]byte(testFeed))
+	}))
+	defer srv.Close()
+
+	a := newTestApp(t, Config{})
+	f := addTestFeed(t, a, srv.URL+"/feed.xml")
+	ctx := context.Background()
+
+	resp, ok, err := a.updateFeed(ctx, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || resp.StatusCode != http.StatusOK {
+		t.Fatalf("first fetch: changed=%v status=%d, want a new revision from a 200", ok, resp.StatusCode)
+	}
+
+	first := reloadFeed(t, a, f)
+	if first.LastUpdate == nil {
+		t.Fatal("first fetch did not record a check")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	resp, ok, err = a.updateFeed(ctx, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok || resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("second fetch: changed=%v status=%d, want an unchanged 304", ok, resp.StatusCode)
+	}
+
+	if len(requests) != 2 {
+		t.Fatalf("got %d requests, want 2", len(requests))
+	}
+	if h := requests[0]; h.Get("If-None-Match") != "" || h.Get("If-Modified-Since") != "" {
+		t.Errorf("first request was conditional: %v", h)
+	}
+	if got := requests[1].Get("If-None-Match"); got != etag {
+		t.Errorf("If-None-Match = %q, want %q", got, etag)
+	}
+	if got := requests[1].Get("If-Modified-Since"); got != lastModified {
+		t.Errorf("If-Modified-Since = %q, want %q", got, lastModified)
+	}
+
+	if history := feedHistory(t, a, f); len(history) != 1 {
+		t.Errorf("history has %d revisions after a 304, want 1", len(history))
+	}
+
+	second := reloadFeed(t, a, f)
+	if second.LastUpdate == nil || !second.LastUpdate.After(*first.LastUpdate) {
+		t.Errorf("last check %v was not moved past %v by the 304", second.LastUpdate, first.LastUpdate)
+	}
+	if second.LastStatus == nil || *second.LastStatus != http.StatusNotModified {
+		t.Errorf("last status = %v, want 304", second.LastStatus)
+	}
+}
@@ -6,4 +6,5 @@ require (
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/sergi/go-diff v1.1.0
+	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
 )
@@ -0,0 +1,156 @@
+package backcast
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leedo/backcast/model"
+)
+
+var updatePeriods = map[string]time.Duration{
+	"hourly":  time.Hour,
+	"daily":   24 * time.Hour,
+	"weekly":  7 * 24 * time.Hour,
+	"monthly": 30 * 24 * time.Hour,
+	"yearly":  365 * 24 * time.Hour,
+}
+
+// headerDelay returns how long the response asks us to wait before the
+// next request, from Cache-Control, Expires or Retry-After.
+func headerDelay(h http.Header, status int, now time.Time) (time.Duration, string) {
+	var (
+		delay  time.Duration
+		reason string
+	)
+
+	if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+		if d, ok := parseRetryAfter(h.Get("Retry-After"), now); ok {
+			return d, "Retry-After"
+		}
+	}
+
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(strings.ToLower(directive))
+		if strings.HasPrefix(directive, "max-age=") {
+			if n, err := strconv.ParseInt(strings.Trim(directive[8:], `"`), 10, 64); err == nil && n > 0 {
+				return time.Duration(n) * time.Second, "Cache-Control max-age"
+			}
+		}
+	}
+
+	if v := h.Get("Expires"); v != "" {
+		if t, err := http.ParseTime(v); err == nil && t.After(now) {
+			delay = t.Sub(now)
+			reason = "Expires"
+		}
+	}
+
+	return delay, reason
+}
+
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now), true
+	}
+	return 0, false
+}
+
+func parseBodyHints(body []byte) model.Hints {
+	var (
+		h         model.Hints
+		stack     []string
+		period    time.Duration
+		frequency int64 = 1
+	)
+
+	dec := newXMLDecoder(body)
+
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name.Local)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			if len(stack) < 2 {
+				continue
+			}
+			name, parent := stack[len(stack)-1], stack[len(stack)-2]
+			text := strings.TrimSpace(string(t))
+
+			switch {
+			case name == "ttl" && parent == "channel":
+				if n, err := strconv.ParseInt(text, 10, 64); err == nil && n > 0 {
+					h.TTL = n * 60
+				}
+			case name == "hour" && parent == "skipHours":
+				if n, err := strconv.Atoi(text); err == nil && n >= 0 && n < 24 {
+					h.SkipHours = append(h.SkipHours, n)
+				}
+			case name == "day" && parent == "skipDays":
+				for d := time.Sunday; d <= time.Saturday; d++ {
+					if strings.EqualFold(text, d.String()) {
+						h.SkipDays = append(h.SkipDays, d.String())
+					}
+				}
+			case name == "updatePeriod":
+				period = updatePeriods[strings.ToLower(text)]
+			case name == "updateFrequency":
+				if n, err := strconv.ParseInt(text, 10, 64); err == nil && n > 0 {
+					frequency = n
+				}
+			}
+		}
+	}
+
+	if period > 0 {
+		h.UpdatePeriod = int64(period/time.Second) / frequency
+	}
+
+	return h
+}
+
+// skipWindow moves t forward to the first hour that the feed does not
+// ask to be skipped. skipHours and skipDays are always in GMT.
+func skipWindow(t time.Time, h model.Hints) time.Time {
+	if len(h.SkipHours) == 0 && len(h.SkipDays) == 0 {
+		return t
+	}
+
+	skipped := func(t time.Time) bool {
+		u := t.UTC()
+		for _, hour := range h.SkipHours {
+			if u.Hour() == hour {
+				return true
+			}
+		}
+		for _, day := range h.SkipDays {
+			if u.Weekday().String() == day {
+				return true
+			}
+		}
+		return false
+	}
+
+	for i := 0; i < 7*24 && skipped(t); i++ {
+		t = t.UTC().Truncate(time.Hour).Add(time.Hour)
+	}
+
+	return t
+}
@@ -0,0 +1,234 @@
+package backcast
+
+import (
+	"context"
+	"math"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leedo/backcast/model"
+)
+
+type hostStatus struct {
+	model.HostLimit
+	CrawlDelay float64 `json:"crawl_delay,omitempty"`
+	Tokens     float64 `json:"tokens"`
+	Active     int     `json:"active"`
+	Override   bool    `json:"override"`
+}
+
+type hostBucket struct {
+	tokens float64
+	last   time.Time
+	active int
+}
+
+type hostLimiter struct {
+	mu        sync.Mutex
+	defaults  model.HostLimit
+	overrides map[string]model.HostLimit
+	delays    map[string]time.Duration
+	hosts     map[string]*hostBucket
+}
+
+func newHostLimiter(c Config) *hostLimiter {
+	return &hostLimiter{
+		defaults: model.HostLimit{
+			Rate:     c.HostRate,
+			Burst:    c.HostBurst,
+			MaxConns: c.HostConns,
+		},
+		overrides: make(map[string]model.HostLimit),
+		delays:    make(map[string]time.Duration),
+		hosts:     make(map[string]*hostBucket),
+	}
+}
+
+func feedHost(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// limit merges a host override with the global defaults, field by field,
+// so an override only has to set the values it changes.
+func (l *hostLimiter) limit(host string) model.HostLimit {
+	lim := l.defaults
+	if o, ok := l.overrides[host]; ok {
+		if o.Rate > 0 {
+			lim.Rate = o.Rate
+		}
+		if o.Burst > 0 {
+			lim.Burst = o.Burst
+		}
+		if o.MaxConns > 0 {
+			lim.MaxConns = o.MaxConns
+		}
+	}
+
+	// a robots.txt Crawl-delay can only make the limit stricter
+	if d, ok := l.delays[host]; ok && d > 0 {
+		if rate := 1 / d.Seconds(); lim.Rate <= 0 || rate < lim.Rate {
+			lim.Rate = rate
+			lim.Burst = 1
+		}
+	}
+	if lim.Burst < 1 {
+		lim.Burst = 1
+	}
+	lim.Host = host
+	return lim
+}
+
+func (l *hostLimiter) bucket(host string, now time.Time) (*hostBucket, model.HostLimit) {
+	lim := l.limit(host)
+	b, ok := l.hosts[host]
+	if !ok {
+		b = &hostBucket{tokens: float64(lim.Burst), last: now}
+		l.hosts[host] = b
+	}
+
+	if lim.Rate > 0 {
+		b.tokens = math.Min(float64(lim.Burst), b.tokens+now.Sub(b.last).Seconds()*lim.Rate)
+	} else {
+		b.tokens = float64(lim.Burst)
+	}
+	b.last = now
+
+	return b, lim
+}
+
+// tryAcquire takes a token and a connection slot for host if both are
+// available. When it fails it returns how long until a token is due.
+func (l *hostLimiter) tryAcquire(host string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, lim := l.bucket(host, time.Now())
+
+	if lim.MaxConns > 0 && b.active >= lim.MaxConns {
+		return false, 0
+	}
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / lim.Rate * float64(time.Second))
+	}
+
+	b.tokens--
+	b.active++
+	return true, 0
+}
+
+func (l *hostLimiter) acquire(ctx context.Context, host string) error {
+	for {
+		ok, wait := l.tryAcquire(host)
+		if ok {
+			return nil
+		}
+		if wait <= 0 {
+			wait = 100 * time.Millisecond
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// wait takes a token for host without a connection slot, for an extra
+// request made under a slot the caller already holds.
+func (l *hostLimiter) wait(ctx context.Context, host string) error {
+	for {
+		l.mu.Lock()
+		b, lim := l.bucket(host, time.Now())
+		if b.tokens >= 1 {
+			b.tokens--
+			l.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - b.tokens) / lim.Rate * float64(time.Second))
+		l.mu.Unlock()
+
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *hostLimiter) release(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if b, ok := l.hosts[host]; ok && b.active > 0 {
+		b.active--
+	}
+}
+
+func (l *hostLimiter) setOverride(o model.HostLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.overrides[o.Host] = o
+}
+
+func (l *hostLimiter) setCrawlDelay(host string, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if d > 0 {
+		l.delays[host] = d
+	} else {
+		delete(l.delays, host)
+	}
+}
+
+func (l *hostLimiter) deleteOverride(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.overrides, host)
+}
+
+func (l *hostLimiter) status() []hostStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	hosts := make(map[string]bool)
+	for h := range l.hosts {
+		hosts[h] = true
+	}
+	for h := range l.overrides {
+		hosts[h] = true
+	}
+
+	var status []hostStatus
+	for h := range hosts {
+		b, lim := l.bucket(h, now)
+		_, override := l.overrides[h]
+		status = append(status, hostStatus{
+			HostLimit:  lim,
+			CrawlDelay: l.delays[h].Seconds(),
+			Tokens:     b.tokens,
+			Active:     b.active,
+			Override:   override,
+		})
+	}
+
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Host < status[j].Host
+	})
+
+	return status
+}
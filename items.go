@@ -0,0 +1,984 @@
+package backcast
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/leedo/backcast/model"
+)
+
+// feeds whose backfill failed are tried again this often
+const backfillInterval = 10 * time.Minute
+
+// feedItem is an RSS item or Atom entry, reduced to the fields that are
+// compared between revisions.
+type feedItem struct {
+	GUID        string           `json:"guid,omitempty"`
+	Title       string           `json:"title,omitempty"`
+	Link        string           `json:"link,omitempty"`
+	PubDate     string           `json:"pub_date,omitempty"`
+	Description string           `json:"description,omitempty"`
+	Content     string           `json:"content,omitempty"`
+	Author      string           `json:"author,omitempty"`
+	Enclosure   *model.Enclosure `json:"enclosure,omitempty"`
+	Categories  []string         `json:"categories,omitempty"`
+	Raw         string           `json:"-"`
+}
+
+// key identifies an item across revisions, by guid or else by link.
+func (i feedItem) key() string {
+	if i.GUID != "" {
+		return i.GUID
+	}
+	if i.Link != "" {
+		return i.Link
+	}
+	return i.Title
+}
+
+// feedChannel is the metadata of the feed itself.
+type feedChannel struct {
+	Title       string
+	Link        string
+	Description string
+	Language    string
+}
+
+type parsedFeed struct {
+	Format  string
+	Channel feedChannel
+	Items   []feedItem
+}
+
+type xmlLink struct {
+	Href   string `xml:"href,attr"`
+	Rel    string `xml:"rel,attr"`
+	Type   string `xml:"type,attr"`
+	Length string `xml:"length,attr"`
+	Text   string `xml:",chardata"`
+}
+
+type xmlEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Type   string `xml:"type,attr"`
+	Length string `xml:"length,attr"`
+}
+
+type xmlAuthor struct {
+	Name string `xml:"name"`
+	Text string `xml:",chardata"`
+}
+
+type xmlCategory struct {
+	Term string `xml:"term,attr"`
+	Text string `xml:",chardata"`
+}
+
+type xmlText struct {
+	Type  string `xml:"type,attr"`
+	Text  string `xml:",chardata"`
+	Inner string `xml:",innerxml"`
+}
+
+func (t xmlText) String() string {
+	if t.Type == "xhtml" {
+		return strings.TrimSpace(t.Inner)
+	}
+	return strings.TrimSpace(t.Text)
+}
+
+// Namespaces of the elements items and channels are read from. Feeds that
+// use a dc: or content: prefix without declaring it get the bare prefix as
+// the namespace, so that is accepted too.
+const (
+	atomNS    = "http://www.w3.org/2005/Atom"
+	atom03NS  = "http://purl.org/atom/ns#"
+	rss090NS  = "http://my.netscape.com/rdf/simple/0.9/"
+	rss10NS   = "http://purl.org/rss/1.0/"
+	dcNS      = "http://purl.org/dc/elements/1.1/"
+	contentNS = "http://purl.org/rss/1.0/modules/content/"
+)
+
+// coreElement reports whether name belongs to RSS, RDF or Atom itself
+// rather than an extension like itunes or media.
+func coreElement(name xml.Name) bool {
+	switch name.Space {
+	case "", atomNS, atom03NS, rss090NS, rss10NS:
+		return true
+	}
+	return false
+}
+
+// xmlItem is an RSS or RDF item or an Atom entry, along with the usual dc
+// and content extensions. Children are matched by namespace as well as
+// name, so an itunes:title or media:description never takes the place of
+// the item's own.
+type xmlItem struct {
+	GUID        string
+	ID          string
+	About       string
+	Title       xmlText
+	Links       []xmlLink
+	PubDate     string
+	Published   string
+	Updated     string
+	Date        string
+	Description xmlText
+	Summary     xmlText
+	Content     xmlText
+	Encoded     string
+
+	Authors    []xmlAuthor
+	Creator    string
+	Enclosures []xmlEnclosure
+	Categories []xmlCategory
+	Subjects   []string
+}
+
+func (x *xmlItem) UnmarshalXML(dec *xml.Decoder, start xml.StartElement) error {
+	for _, a := range start.Attr {
+		if a.Name.Local == "about" {
+			x.About = a.Value
+		}
+	}
+
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		var el xml.StartElement
+		switch t := tok.(type) {
+		case xml.EndElement:
+			return nil
+		case xml.StartElement:
+			el = t
+		default:
+			continue
+		}
+
+		var dest interface{}
+		switch el.Name.Space {
+		case dcNS, "dc":
+			switch el.Name.Local {
+			case "date":
+				dest = &x.Date
+			case "creator":
+				dest = &x.Creator
+			case "subject":
+				x.Subjects = append(x.Subjects, "")
+				dest = &x.Subjects[len(x.Subjects)-1]
+			}
+		case contentNS, "content":
+			if el.Name.Local == "encoded" {
+				dest = &x.Encoded
+			}
+		default:
+			if coreElement(el.Name) {
+				dest = x.coreField(el.Name.Local)
+			}
+		}
+
+		if dest == nil {
+			err = dec.Skip()
+		} else {
+			err = dec.DecodeElement(dest, &el)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// coreField is where an RSS, RDF or Atom child element of an item goes.
+func (x *xmlItem) coreField(local string) interface{} {
+	switch local {
+	case "guid":
+		return &x.GUID
+	case "id":
+		return &x.ID
+	case "title":
+		return &x.Title
+	case "link":
+		x.Links = append(x.Links, xmlLink{})
+		return &x.Links[len(x.Links)-1]
+	case "pubDate":
+		return &x.PubDate
+	case "published", "issued":
+		return &x.Published
+	case "updated", "modified":
+		return &x.Updated
+	case "description":
+		return &x.Description
+	case "summary":
+		return &x.Summary
+	case "content":
+		return &x.Content
+	case "author":
+		x.Authors = append(x.Authors, xmlAuthor{})
+		return &x.Authors[len(x.Authors)-1]
+	case "enclosure":
+		x.Enclosures = append(x.Enclosures, xmlEnclosure{})
+		return &x.Enclosures[len(x.Enclosures)-1]
+	case "category":
+		x.Categories = append(x.Categories, xmlCategory{})
+		return &x.Categories[len(x.Categories)-1]
+	}
+	return nil
+}
+
+func newEnclosure(url, typ, length string) *model.Enclosure {
+	n, _ := strconv.ParseInt(strings.TrimSpace(length), 10, 64)
+	return &model.Enclosure{URL: strings.TrimSpace(url), Type: strings.TrimSpace(typ), Length: n}
+}
+
+func (x xmlItem) item() feedItem {
+	i := feedItem{
+		GUID:  strings.TrimSpace(firstNonEmpty(x.GUID, x.ID, x.About)),
+		Title: x.Title.String(),
+	}
+
+	// RSS puts the link in the element text, Atom in the href of the
+	// alternate link
+	for _, l := range x.Links {
+		if l.Rel == "enclosure" && l.Href != "" && i.Enclosure == nil {
+			i.Enclosure = newEnclosure(l.Href, l.Type, l.Length)
+		}
+		if i.Link != "" {
+			continue
+		}
+		if l.Href == "" {
+			i.Link = strings.TrimSpace(l.Text)
+			continue
+		}
+		if l.Rel == "" || l.Rel == "alternate" {
+			i.Link = l.Href
+		}
+	}
+
+	for _, e := range x.Enclosures {
+		if e.URL != "" {
+			i.Enclosure = newEnclosure(e.URL, e.Type, e.Length)
+			break
+		}
+	}
+
+	i.PubDate = strings.TrimSpace(firstNonEmpty(x.PubDate, x.Published, x.Date, x.Updated))
+	i.Description = firstNonEmpty(x.Description.String(), x.Summary.String())
+	i.Content = firstNonEmpty(strings.TrimSpace(x.Encoded), x.Content.String())
+
+	i.Author = strings.TrimSpace(x.Creator)
+	for _, a := range x.Authors {
+		if i.Author != "" {
+			break
+		}
+		i.Author = strings.TrimSpace(firstNonEmpty(a.Name, a.Text))
+	}
+
+	for _, c := range x.Categories {
+		if term := strings.TrimSpace(firstNonEmpty(c.Term, c.Text)); term != "" {
+			i.Categories = append(i.Categories, term)
+		}
+	}
+	for _, s := range x.Subjects {
+		if s = strings.TrimSpace(s); s != "" {
+			i.Categories = append(i.Categories, s)
+		}
+	}
+
+	return i
+}
+
+// decode reads one child element of an RSS channel or Atom feed,
+// reporting whether it was one we keep.
+func (c *feedChannel) decode(dec *xml.Decoder, start *xml.StartElement) (bool, error) {
+	if !coreElement(start.Name) {
+		return false, nil
+	}
+
+	switch start.Name.Local {
+	case "title":
+		var t xmlText
+		if err := dec.DecodeElement(&t, start); err != nil {
+			return true, err
+		}
+		c.Title = t.String()
+	case "link":
+		var l xmlLink
+		if err := dec.DecodeElement(&l, start); err != nil {
+			return true, err
+		}
+		if c.Link == "" && l.Href == "" {
+			c.Link = strings.TrimSpace(l.Text)
+		} else if c.Link == "" && (l.Rel == "" || l.Rel == "alternate") {
+			c.Link = l.Href
+		}
+	case "description", "subtitle":
+		var t xmlText
+		if err := dec.DecodeElement(&t, start); err != nil {
+			return true, err
+		}
+		c.Description = t.String()
+	case "language":
+		var s string
+		if err := dec.DecodeElement(&s, start); err != nil {
+			return true, err
+		}
+		c.Language = strings.TrimSpace(s)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// parseFeed reads the channel and items of an RSS, RDF or Atom document.
+func parseFeed(body []byte) (parsedFeed, error) {
+	var (
+		p     parsedFeed
+		stack []string
+	)
+
+	dec := newXMLDecoder(body)
+
+	for {
+		offset := dec.InputOffset()
+
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return p, err
+		}
+
+		if _, ok := tok.(xml.EndElement); ok && len(stack) > 0 {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		if p.Format == "" {
+			switch start.Name.Local {
+			case "rss", "RDF", "feed":
+				p.Format = start.Name.Local
+			default:
+				return p, fmt.Errorf("unknown feed format, root element is <%s>", start.Name.Local)
+			}
+			stack = append(stack, start.Name.Local)
+			continue
+		}
+
+		if coreElement(start.Name) && (start.Name.Local == "item" || start.Name.Local == "entry") {
+			var x xmlItem
+			if err := dec.DecodeElement(&x, &start); err != nil {
+				return p, err
+			}
+			i := x.item()
+			i.Raw = string(body[offset:dec.InputOffset()])
+			p.Items = append(p.Items, i)
+			continue
+		}
+
+		// anything after the root element closed is not part of the feed
+		if len(stack) == 0 {
+			break
+		}
+
+		// channel metadata sits directly in <channel>, or in <feed> for Atom
+		if parent := stack[len(stack)-1]; parent == "channel" || parent == "feed" && len(stack) == 1 {
+			ok, err := p.Channel.decode(dec, &start)
+			if err != nil {
+				return p, err
+			}
+			if ok {
+				continue
+			}
+		}
+
+		stack = append(stack, start.Name.Local)
+	}
+
+	if p.Format == "" {
+		return p, fmt.Errorf("no feed found in document")
+	}
+
+	return p, nil
+}
+
+type itemChange struct {
+	Key    string    `json:"key"`
+	Old    *feedItem `json:"old,omitempty"`
+	New    *feedItem `json:"new,omitempty"`
+	Fields []string  `json:"fields,omitempty"`
+}
+
+type itemChanges struct {
+	Added   []itemChange `json:"added"`
+	Removed []itemChange `json:"removed"`
+	Changed []itemChange `json:"changed"`
+}
+
+func changedFields(a, b feedItem) []string {
+	var fields []string
+	if a.Title != b.Title {
+		fields = append(fields, "title")
+	}
+	if a.Link != b.Link {
+		fields = append(fields, "link")
+	}
+	if a.PubDate != b.PubDate {
+		fields = append(fields, "pub_date")
+	}
+	if a.Description != b.Description {
+		fields = append(fields, "description")
+	}
+	if a.Content != b.Content {
+		fields = append(fields, "content")
+	}
+	if a.Author != b.Author {
+		fields = append(fields, "author")
+	}
+	if !equalEnclosures(a.Enclosure, b.Enclosure) {
+		fields = append(fields, "enclosure")
+	}
+	if strings.Join(a.Categories, "\n") != strings.Join(b.Categories, "\n") {
+		fields = append(fields, "categories")
+	}
+	return fields
+}
+
+func equalEnclosures(a, b *model.Enclosure) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+type fieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+func (i feedItem) field(name string) interface{} {
+	switch name {
+	case "title":
+		return i.Title
+	case "link":
+		return i.Link
+	case "pub_date":
+		return i.PubDate
+	case "description":
+		return i.Description
+	case "content":
+		return i.Content
+	case "author":
+		return i.Author
+	case "enclosure":
+		return i.Enclosure
+	case "categories":
+		return i.Categories
+	}
+	return nil
+}
+
+// fieldChanges is changedFields with the values on either side.
+func fieldChanges(a, b feedItem) []fieldChange {
+	changes := []fieldChange{}
+	for _, f := range changedFields(a, b) {
+		changes = append(changes, fieldChange{f, a.field(f), b.field(f)})
+	}
+	return changes
+}
+
+// diffItems compares the items of two revisions by key.
+func diffItems(old, new []feedItem) itemChanges {
+	c := itemChanges{
+		Added:   []itemChange{},
+		Removed: []itemChange{},
+		Changed: []itemChange{},
+	}
+
+	before := make(map[string]feedItem)
+	for _, i := range old {
+		before[i.key()] = i
+	}
+
+	seen := make(map[string]bool)
+	for _, i := range new {
+		i := i
+		k := i.key()
+		seen[k] = true
+
+		o, ok := before[k]
+		if !ok {
+			c.Added = append(c.Added, itemChange{Key: k, New: &i})
+			continue
+		}
+		if fields := changedFields(o, i); len(fields) > 0 {
+			c.Changed = append(c.Changed, itemChange{Key: k, Old: &o, New: &i, Fields: fields})
+		}
+	}
+
+	for _, i := range old {
+		i := i
+		if !seen[i.key()] {
+			c.Removed = append(c.Removed, itemChange{Key: i.key(), Old: &i})
+		}
+	}
+
+	return c
+}
+
+var dateLayouts = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC3339,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"Mon, 2 Jan 2006 15:04 -0700",
+	"Mon, 2 Jan 2006 15:04 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 MST",
+	time.RFC822Z,
+	time.RFC822,
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// parseDate reads the dates feeds actually use, which are only sometimes
+// the RFC 822 or RFC 3339 dates the specs ask for.
+func parseDate(s string) *time.Time {
+	s = strings.TrimSpace(s)
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			t = t.UTC()
+			return &t
+		}
+	}
+	return nil
+}
+
+func itemFromModel(m model.Item) feedItem {
+	return feedItem{
+		GUID:        m.GUID,
+		Title:       m.Title,
+		Link:        m.Link,
+		PubDate:     m.PubDate,
+		Description: m.Description,
+		Content:     m.Content,
+		Author:      m.Author,
+		Enclosure:   m.Enclosure,
+		Categories:  m.Categories,
+	}
+}
+
+func (i feedItem) model(position int) model.Item {
+	return model.Item{
+		Key:         i.key(),
+		GUID:        i.GUID,
+		Title:       i.Title,
+		Link:        i.Link,
+		PubDate:     i.PubDate,
+		Published:   parseDate(i.PubDate),
+		Description: i.Description,
+		Content:     i.Content,
+		Author:      i.Author,
+		Enclosure:   i.Enclosure,
+		Categories:  i.Categories,
+		Position:    position,
+		Raw:         i.Raw,
+	}
+}
+
+// indexRevision parses one revision into its channel and items. A body
+// that does not parse is recorded as such, the revision itself is already
+// archived either way.
+func (a *App) indexRevision(ctx context.Context, f model.Feed, rv model.Revision, body string, tx *sql.Tx) error {
+	p, err := parseFeed([]byte(body))
+	if err != nil {
+		_, err := f.IndexRevision(ctx, rv, model.Channel{ParseError: err.Error()}, nil, tx)
+		return err
+	}
+
+	ch := model.Channel{
+		Format:      p.Format,
+		Title:       p.Channel.Title,
+		Link:        p.Channel.Link,
+		Description: p.Channel.Description,
+		Language:    p.Channel.Language,
+	}
+
+	items := make([]model.Item, len(p.Items))
+	for n, i := range p.Items {
+		items[n] = i.model(n)
+	}
+
+	res, err := f.IndexRevision(ctx, rv, ch, items, tx)
+	if err != nil {
+		return err
+	}
+
+	for _, i := range removedItems(res, items) {
+		if err := f.RecordRemoval(ctx, i, rv, tx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removedItems tells items that were deleted from items that fell off the
+// end of a feed listing only the latest few. An item only falls off when
+// something new pushed it out, and then it is the oldest one: by pubDate
+// when the items have dates, or else by position at the end of the
+// previous listing.
+func removedItems(res model.IndexResult, current []model.Item) []model.Item {
+	if res.Added == 0 {
+		return res.Gone
+	}
+
+	var oldest *time.Time
+	for _, i := range current {
+		if i.Published == nil {
+			oldest = nil
+			break
+		}
+		if oldest == nil || i.Published.Before(*oldest) {
+			oldest = i.Published
+		}
+	}
+
+	tail := res.PreviousCount - len(res.Gone)
+
+	var removed []model.Item
+	for _, i := range res.Gone {
+		expired := i.Position >= tail
+		if oldest != nil && i.Published != nil {
+			expired = !i.Published.After(*oldest)
+		}
+		if !expired {
+			removed = append(removed, i)
+		}
+	}
+
+	return removed
+}
+
+// indexCommit parses the revision just committed on top of base, whose
+// body the caller passes in. Items are matched against the revision
+// indexed before them, so when the index lags behind base the revision is
+// left for backfillItems to reach in order, and false is returned.
+func (a *App) indexCommit(ctx context.Context, f model.Feed, base, body string, tx *sql.Tx) (bool, error) {
+	last, err := f.LastIndexedRevision(ctx, tx)
+	if err != nil {
+		return false, err
+	}
+
+	if base != strconv.FormatInt(last, 10) && (base != "" || last != 0) {
+		return false, nil
+	}
+
+	head, err := f.HeadRevision(ctx, tx)
+	if err != nil {
+		return false, err
+	} else if head == "" {
+		return true, nil
+	}
+
+	rv, err := f.GetRevision(ctx, head, tx)
+	if err != nil {
+		return false, err
+	}
+
+	return true, a.indexRevision(ctx, f, rv, body, tx)
+}
+
+// indexItems replays the history of f to parse every revision committed
+// since the last one indexed.
+func (a *App) indexItems(ctx context.Context, f model.Feed, tx *sql.Tx) error {
+	last, err := f.LastIndexedRevision(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	revisions, err := f.Replay(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range revisions {
+		if r.ID <= last {
+			continue
+		}
+		if err := a.indexRevision(ctx, f, r.Revision, r.Body, tx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// startBackfill runs backfillItems at startup, whenever a commit leaves a
+// feed's index behind, and every backfillInterval to retry feeds whose
+// backfill failed.
+func (a *App) startBackfill(ctx context.Context) {
+	t := time.NewTicker(backfillInterval)
+	defer t.Stop()
+
+	for {
+		if err := a.backfillItems(ctx); err != nil {
+			log.Printf("failed to index items: %v", err)
+		}
+
+		select {
+		case <-a.reindex:
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// requestBackfill wakes startBackfill without waiting for it.
+func (a *App) requestBackfill() {
+	select {
+	case a.reindex <- struct{}{}:
+	default:
+	}
+}
+
+// backfillItems brings the items of every feed up to its current
+// revision, one feed per transaction so commits are not held up for long.
+// Commits index their own revision once a feed has caught up.
+func (a *App) backfillItems(ctx context.Context) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	feeds, err := model.FindUnindexedFeeds(ctx, tx)
+	tx.Rollback()
+
+	if err != nil {
+		return err
+	}
+
+	for _, f := range feeds {
+		if err := a.backfillFeed(ctx, f); err != nil {
+			log.Printf("failed to index items of feed %d (%s): %v", f.ID, f.URL, err)
+			continue
+		}
+		log.Printf("indexed items of feed %d (%s)", f.ID, f.URL)
+	}
+
+	return nil
+}
+
+func (a *App) backfillFeed(ctx context.Context, f model.Feed) error {
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := a.indexItems(ctx, f, tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+type itemList struct {
+	Channel    model.Channel `json:"channel"`
+	ParseError string        `json:"parse_error,omitempty"`
+	Items      []model.Item  `json:"items"`
+}
+
+// feedItemsHandler lists the items of the newest revision that parsed,
+// with the error of the newest revision if that one did not.
+func (a *App) feedItemsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	defer tx.Rollback()
+
+	feed, err := model.GetFeed(ctx, ps.ByName("id"), tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	var l itemList
+
+	if l.Channel, l.ParseError, err = feed.CurrentChannel(ctx, tx); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if l.Items, err = feed.CurrentItems(ctx, tx); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(l); err != nil {
+		jsonError(err, w)
+		return
+	}
+}
+
+type itemVersion struct {
+	Revision  int64         `json:"revision"`
+	CreatedAt time.Time     `json:"created_at"`
+	Item      model.Item    `json:"item"`
+	Changes   []fieldChange `json:"changes"`
+}
+
+type itemHistory struct {
+	Key      string        `json:"key"`
+	Versions []itemVersion `json:"versions"`
+}
+
+// itemHistoryHandler serves /api/feed/:id/items/:guid/history. The guid
+// is matched as a catch-all, since guids are often URLs with slashes.
+func (a *App) itemHistoryHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+
+	key := strings.TrimPrefix(ps.ByName("guid"), "/")
+	if !strings.HasSuffix(key, "/history") {
+		jsonError(fmt.Errorf("unknown item path %q", key), w)
+		return
+	}
+	key = strings.TrimSuffix(key, "/history")
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	defer tx.Rollback()
+
+	feed, err := model.GetFeed(ctx, ps.ByName("id"), tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	id, err := feed.FindItem(ctx, key, tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	versions, err := feed.ItemHistory(ctx, id, tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	h := itemHistory{Versions: []itemVersion{}}
+
+	var prev *feedItem
+	for _, v := range versions {
+		h.Key = v.Key
+		cur := itemFromModel(v)
+
+		iv := itemVersion{Revision: v.Revision, CreatedAt: v.CreatedAt, Item: v, Changes: []fieldChange{}}
+		if prev != nil {
+			iv.Changes = fieldChanges(*prev, cur)
+		}
+
+		h.Versions = append(h.Versions, iv)
+		prev = &cur
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(h); err != nil {
+		jsonError(err, w)
+		return
+	}
+}
+
+// removedRSSHandler serves the items deleted from a feed, each in its last
+// version before it disappeared, most recently removed first.
+func (a *App) removedRSSHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	defer tx.Rollback()
+
+	feed, err := model.GetFeed(ctx, ps.ByName("id"), tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	ch, _, err := feed.CurrentChannel(ctx, tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	removals, err := feed.Removals(ctx, tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	items := make([]model.Item, len(removals))
+	for n, rm := range removals {
+		items[n] = rm.Item
+	}
+
+	title := firstNonEmpty(ch.Title, feed.URL)
+	out := rssChannel{
+		Title:       "Removed from " + title,
+		Link:        firstNonEmpty(ch.Link, feed.URL),
+		Description: "Items removed from " + title + " since it was first archived.",
+		Language:    ch.Language,
+	}
+	if len(removals) > 0 {
+		out.LastBuildDate = removals[0].RemovedAt.Format(time.RFC1123Z)
+	}
+
+	writeRSS(w, out, items)
+}
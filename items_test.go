@@ -0,0 +1,285 @@
+package backcast
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/leedo/backcast/model"
+)
+
+func feedIndex(t *testing.T, a *App, f model.Feed) (int64, []model.Item) {
+	t.Helper()
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer tx.Rollback()
+
+	last, err := f.LastIndexedRevision(context.Background(), tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := f.AllItems(context.Background(), tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return last, items
+}
+
+// TestLaggingIndexIsBackfilled checks a commit on top of an unindexed
+// history leaves the replay to the backfill instead of doing it in the
+// commit transaction.
+func TestLaggingIndexIsBackfilled(t *testing.T) {
+	episodes := 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<rss version="2.0"><channel><title>Test</title>`)
+		for i := 1; i <= episodes; i++ {
+			fmt.Fprintf(w, `<item><guid>%d</guid><title>Episode %d</title></item>`, i, i)
+		}
+		fmt.Fprint(w, `</channel></rss>`)
+	}))
+	defer srv.Close()
+
+	a := newTestApp(t, Config{})
+	f := addTestFeed(t, a, srv.URL+"/feed.xml")
+	ctx := context.Background()
+
+	// f is deliberately not reloaded between updates, the pipeline must
+	// diff against the head in the database
+	update := func() {
+		t.Helper()
+		if _, ok, err := a.updateFeed(ctx, f); !ok || err != nil {
+			t.Fatalf("update: %v %v", ok, err)
+		}
+	}
+
+	update()
+	if last, items := feedIndex(t, a, f); last == 0 || len(items) != 1 {
+		t.Fatalf("first commit indexed revision %d with %d items", last, len(items))
+	}
+
+	// as if the feed had been archived before items were parsed
+	tx, err := a.beginWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.DeleteItems(ctx, tx); err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+
+	episodes++
+	update()
+	if last, _ := feedIndex(t, a, f); last != 0 {
+		t.Fatalf("commit on a lagging index indexed up to revision %d", last)
+	}
+
+	if err := a.backfillItems(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	f = reloadFeed(t, a, f)
+	last, items := feedIndex(t, a, f)
+	if strconv.FormatInt(last, 10) != f.CurrentRevision || len(items) != 2 {
+		t.Fatalf("backfill indexed up to revision %d of %s with %d items", last, f.CurrentRevision, len(items))
+	}
+
+	// caught up, the next commit indexes itself
+	episodes++
+	update()
+	f = reloadFeed(t, a, f)
+	if last, items := feedIndex(t, a, f); strconv.FormatInt(last, 10) != f.CurrentRevision || len(items) != 3 {
+		t.Errorf("commit after backfill indexed up to revision %d of %s with %d items", last, f.CurrentRevision, len(items))
+	}
+}
+
+func TestParseFeedNamespaces(t *testing.T) {
+	const rss = `<?xml version="1.0"?>
+<rss version="2.0" xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd"
+  xmlns:media="http://search.yahoo.com/mrss/" xmlns:dc="http://purl.org/dc/elements/1.1/"
+  xmlns:content="http://purl.org/rss/1.0/modules/content/">
+<channel>
+  <title>Show</title>
+  <description>About the show</description>
+  <itunes:subtitle>Subtitle</itunes:subtitle>
+  <itunes:title>Itunes show</itunes:title>
+  <item>
+    <guid>12</guid>
+    <title>Episode 12: Real</title>
+    <itunes:title>Real</itunes:title>
+    <media:title>Media</media:title>
+    <description>Show notes</description>
+    <itunes:summary>Summary</itunes:summary>
+    <media:description>Media description</media:description>
+    <dc:creator>Jane</dc:creator>
+    <content:encoded>Full text</content:encoded>
+    <media:content url="http://example.com/video.mp4"/>
+  </item>
+</channel>
+</rss>
+<!-- trailing --><junk/>`
+
+	p, err := parseFeed([]byte(rss))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Channel.Title != "Show" || p.Channel.Description != "About the show" {
+		t.Errorf("channel is %+v, extensions overrode it", p.Channel)
+	}
+
+	if len(p.Items) != 1 {
+		t.Fatalf("parsed %d items, want 1", len(p.Items))
+	}
+
+	i := p.Items[0]
+	for _, c := range []struct{ field, got, want string }{
+		{"title", i.Title, "Episode 12: Real"},
+		{"description", i.Description, "Show notes"},
+		{"author", i.Author, "Jane"},
+		{"content", i.Content, "Full text"},
+	} {
+		if c.got != c.want {
+			t.Errorf("item %s = %q, want %q", c.field, c.got, c.want)
+		}
+	}
+
+	const atom = `<feed xmlns="http://www.w3.org/2005/Atom" xmlns:media="http://search.yahoo.com/mrss/">
+<title>Blog</title>
+<entry><id>urn:1</id><title>Post</title><media:title>Thumb</media:title><summary>Short</summary>
+<link rel="alternate" href="http://example.com/1"/></entry>
+</feed>`
+
+	p, err = parseFeed([]byte(atom))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Items) != 1 || p.Items[0].Title != "Post" || p.Items[0].Description != "Short" || p.Items[0].Link != "http://example.com/1" {
+		t.Errorf("atom entries are %+v", p.Items)
+	}
+}
+
+// TestItemHandlersDoNotWrite checks reading items leaves indexing to the
+// commit path and the backfill.
+func TestItemHandlersDoNotWrite(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testFeed))
+	}))
+	defer srv.Close()
+
+	a := newTestApp(t, Config{})
+	f := addTestFeed(t, a, srv.URL+"/feed.xml")
+	ctx := context.Background()
+
+	if _, ok, err := a.updateFeed(ctx, f); !ok || err != nil {
+		t.Fatalf("update: %v %v", ok, err)
+	}
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.DeleteItems(ctx, tx); err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+
+	// a writer holding the lock must not block the readers
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	router := a.routes()
+	id := strconv.FormatInt(f.ID, 10)
+	for _, path := range []string{"/items", "/removed.rss", "/complete.rss"} {
+		done := make(chan int)
+		go func() {
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/feed/"+id+path, nil))
+			done <- rec.Code
+		}()
+
+		select {
+		case code := <-done:
+			if code != http.StatusOK {
+				t.Errorf("GET %s answered %d", path, code)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("GET %s waited on the write lock", path)
+		}
+	}
+
+	if last, _ := feedIndex(t, a, f); last != 0 {
+		t.Errorf("reading items indexed up to revision %d", last)
+	}
+}
+
+// TestBackfillRunsAfterLaggingCommit checks a feed whose index falls behind
+// while the app is running is caught up without a restart.
+func TestBackfillRunsAfterLaggingCommit(t *testing.T) {
+	episodes := 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<rss version="2.0"><channel><title>Test</title>`)
+		for i := 1; i <= episodes; i++ {
+			fmt.Fprintf(w, `<item><guid>%d</guid><title>Episode %d</title></item>`, i, i)
+		}
+		fmt.Fprint(w, `</channel></rss>`)
+	}))
+	defer srv.Close()
+
+	a := newTestApp(t, Config{})
+	f := addTestFeed(t, a, srv.URL+"/feed.xml")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, ok, err := a.updateFeed(ctx, f); !ok || err != nil {
+		t.Fatalf("update: %v %v", ok, err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		a.startBackfill(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.DeleteItems(ctx, tx); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	episodes++
+	if _, ok, err := a.updateFeed(ctx, f); !ok || err != nil {
+		t.Fatalf("update: %v %v", ok, err)
+	}
+
+	f = reloadFeed(t, a, f)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		last, items := feedIndex(t, a, f)
+		if strconv.FormatInt(last, 10) == f.CurrentRevision && len(items) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("index is at revision %d of %s with %d items, want caught up", last, f.CurrentRevision, len(items))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
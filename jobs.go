@@ -0,0 +1,242 @@
+package backcast
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/leedo/backcast/model"
+)
+
+const (
+	// finished jobs are kept around this long for clients polling them
+	jobRetention = 7 * 24 * time.Hour
+
+	maxJobWait      = 5 * time.Minute
+	jobPollInterval = 250 * time.Millisecond
+)
+
+// enqueueJob records a refresh of f and wakes the scanner. The queue
+// lives in the database, so nothing is lost if the process restarts
+// before the job runs.
+func (a *App) enqueueJob(ctx context.Context, f model.Feed, priority int, reason string, tx *sql.Tx) (model.Job, error) {
+	j, err := model.EnqueueJob(ctx, f.ID, priority, reason, tx)
+	if err != nil {
+		return j, err
+	}
+
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+
+	return j, nil
+}
+
+// claimJobs claims pending jobs and loads their feeds. Jobs for feeds
+// that no longer exist, because they were merged away, fail right here.
+func (a *App) claimJobs(ctx context.Context, limit int) ([]scanItem, error) {
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	jobs, err := model.ClaimJobs(ctx, a.config.InstanceID, now, now.Add(-a.config.LeaseDuration), limit, tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	var items []scanItem
+	for i := range jobs {
+		j := jobs[i]
+		f, err := model.GetFeed(ctx, strconv.FormatInt(j.Feed, 10), tx)
+		if err == sql.ErrNoRows {
+			if _, err := j.Finish(ctx, false, "feed no longer exists", tx); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			continue
+		} else if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		items = append(items, scanItem{feed: f, job: &j})
+	}
+
+	if err := model.PruneJobs(ctx, now.Add(-jobRetention), tx); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return items, tx.Commit()
+}
+
+// startJob marks a queued job as running when a worker picks it up.
+func (a *App) startJob(ctx context.Context, j *model.Job) (bool, error) {
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		return false, err
+	}
+
+	ok, err := j.Start(ctx, a.config.InstanceID, time.Now(), tx)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	return ok, tx.Commit()
+}
+
+func (a *App) releaseJobs(ctx context.Context, jobs []model.Job) error {
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		return err
+	}
+
+	for _, j := range jobs {
+		if err := j.Release(ctx, tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (a *App) finishJob(ctx context.Context, j model.Job, changed bool, fetchErr error) error {
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		return err
+	}
+
+	var msg string
+	if fetchErr != nil {
+		msg = fetchErr.Error()
+	}
+
+	ok, err := j.Finish(ctx, changed, msg, tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if !ok {
+		log.Printf("job %d was claimed again after its lease ran out, not recording this run", j.ID)
+	}
+
+	return tx.Commit()
+}
+
+// jobWait reads how long a request wants to wait for its job to finish.
+func jobWait(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("wait")
+	if v == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, err
+	}
+	if d > maxJobWait {
+		d = maxJobWait
+	}
+
+	return d, nil
+}
+
+// waitJob polls a job until it finishes or d runs out, and returns the
+// job as it was last seen.
+func (a *App) waitJob(r *http.Request, j model.Job, d time.Duration) (model.Job, error) {
+	if d <= 0 {
+		return j, nil
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), d)
+	defer cancel()
+
+	t := time.NewTicker(jobPollInterval)
+	defer t.Stop()
+
+	for !j.Finished() {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return j, nil
+		}
+
+		tx, err := a.db.Begin()
+		if err != nil {
+			return j, err
+		}
+
+		j, err = model.GetJob(ctx, strconv.FormatInt(j.ID, 10), tx)
+		tx.Rollback()
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return j, nil
+			}
+			return j, err
+		}
+	}
+
+	return j, nil
+}
+
+func (a *App) jobHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	j, err := model.GetJob(ctx, ps.ByName("id"), tx)
+	tx.Rollback()
+
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	wait, err := jobWait(r)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if j, err = a.waitJob(r, j, wait); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(j); err != nil {
+		jsonError(err, w)
+		return
+	}
+}
@@ -0,0 +1,175 @@
+package backcast
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/leedo/backcast/model"
+)
+
+func jobStatus(t *testing.T, a *App, j model.Job) string {
+	t.Helper()
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer tx.Rollback()
+
+	j, err = model.GetJob(context.Background(), strconv.FormatInt(j.ID, 10), tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return j.Status
+}
+
+// TestJobsRunOnlyWhenStarted checks jobs waiting behind a host limit are
+// queued, not running, until a worker fetches their feed.
+func TestJobsRunOnlyWhenStarted(t *testing.T) {
+	var (
+		started = make(chan string, 3)
+		unblock = make(chan struct{})
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- r.URL.Path
+		<-unblock
+		w.Write([]byte(testFeed))
+	}))
+	defer srv.Close()
+
+	a := newTestApp(t, Config{Workers: 4, HostConns: 1})
+	ctx := context.Background()
+
+	var jobs []model.Job
+	for i := 0; i < 3; i++ {
+		f := addTestFeed(t, a, fmt.Sprintf("%s/feed/%d", srv.URL, i))
+
+		tx, err := a.beginWrite()
+		if err != nil {
+			t.Fatal(err)
+		}
+		j, err := a.enqueueJob(ctx, f, model.PriorityManual, "test", tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.Commit()
+
+		jobs = append(jobs, j)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		a.startScanner(ctx)
+		close(done)
+	}()
+
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no feed was fetched")
+	}
+
+	counts := make(map[string]int)
+	for _, j := range jobs {
+		counts[jobStatus(t, a, j)]++
+	}
+
+	if counts[model.JobRunning] != 1 || counts[model.JobQueued] != 2 {
+		t.Errorf("job statuses %v with one fetch in flight, want 1 running and 2 queued", counts)
+	}
+
+	close(unblock)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, j := range jobs {
+		for jobStatus(t, a, j) != model.JobDone && time.Now().Before(deadline) {
+			time.Sleep(20 * time.Millisecond)
+		}
+		if s := jobStatus(t, a, j); s != model.JobDone {
+			t.Errorf("job %d is %s, want done", j.ID, s)
+		}
+	}
+}
+
+// TestJobClaims checks a request for a feed whose job is queued joins that
+// job, and that a worker whose claim ran out cannot finish the job after
+// it was claimed again.
+func TestJobClaims(t *testing.T) {
+	a := newTestApp(t, Config{})
+	f := addTestFeed(t, a, "http://example.com/feed.xml")
+	ctx := context.Background()
+
+	enqueue := func() model.Job {
+		t.Helper()
+		tx, err := a.beginWrite()
+		if err != nil {
+			t.Fatal(err)
+		}
+		j, err := a.enqueueJob(ctx, f, model.PriorityManual, "test", tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		return j
+	}
+
+	j := enqueue()
+	items, err := a.claimJobs(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].job.ID != j.ID {
+		t.Fatalf("claimed %d jobs, want job %d", len(items), j.ID)
+	}
+
+	if again := enqueue(); again.ID != j.ID {
+		t.Errorf("request for a feed with a queued job created job %d, want %d", again.ID, j.ID)
+	}
+
+	// the claim runs out and the job is claimed again
+	tx, err := a.beginWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	reclaimed, err := model.ClaimJobs(ctx, a.config.InstanceID, later, later, 10, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if len(reclaimed) != 1 {
+		t.Fatalf("reclaimed %d jobs, want 1", len(reclaimed))
+	}
+
+	if err := a.finishJob(ctx, *items[0].job, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if s := jobStatus(t, a, j); s != model.JobQueued {
+		t.Errorf("job is %s after a stale claim finished it, want queued", s)
+	}
+
+	if err := a.finishJob(ctx, reclaimed[0], true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if s := jobStatus(t, a, j); s != model.JobDone {
+		t.Errorf("job is %s after the current claim finished it, want done", s)
+	}
+}
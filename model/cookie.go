@@ -0,0 +1,130 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Cookie is a cookie in the shared jar of feeds that opted into cookies.
+// HostOnly cookies are only sent to Domain itself, the rest to its
+// subdomains as well.
+type Cookie struct {
+	Domain    string     `json:"domain"`
+	Path      string     `json:"path"`
+	Name      string     `json:"name"`
+	Value     string     `json:"value"`
+	HostOnly  bool       `json:"host_only"`
+	Secure    bool       `json:"secure"`
+	HTTPOnly  bool       `json:"http_only"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+func (c Cookie) Expired(now time.Time) bool {
+	return c.Expires != nil && !c.Expires.After(now)
+}
+
+// CookieDomains lists host and each of its parent domains, which are the
+// domains that may hold cookies sent to host.
+func CookieDomains(host string) []string {
+	var domains []string
+	for {
+		domains = append(domains, host)
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return domains
+		}
+		host = host[i+1:]
+	}
+}
+
+func GetCookies(ctx context.Context, domains []string, db *sql.Tx) ([]Cookie, error) {
+	if len(domains) == 0 {
+		return nil, nil
+	}
+
+	query := `SELECT domain, path, name, value, host_only, secure, http_only, expires, updated_at FROM cookie WHERE domain IN (?` +
+		strings.Repeat(",?", len(domains)-1) + `) ORDER BY domain, path, name`
+
+	args := make([]interface{}, len(domains))
+	for i, d := range domains {
+		args[i] = d
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanCookies(rows)
+}
+
+func scanCookies(rows *sql.Rows) ([]Cookie, error) {
+	defer rows.Close()
+
+	cookies := []Cookie{}
+	for rows.Next() {
+		var c Cookie
+		if err := rows.Scan(&c.Domain, &c.Path, &c.Name, &c.Value, &c.HostOnly, &c.Secure, &c.HTTPOnly, &c.Expires, &c.UpdatedAt); err != nil {
+			return nil, err
+		}
+		cookies = append(cookies, c)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return cookies, nil
+}
+
+// GetSiteCookies returns the cookies of site and its subdomains, which
+// are all the cookies a fetch from the site can be sent.
+func GetSiteCookies(ctx context.Context, site string, db *sql.Tx) ([]Cookie, error) {
+	const query = `SELECT domain, path, name, value, host_only, secure, http_only, expires, updated_at FROM cookie
+    WHERE domain=? OR domain LIKE ? ORDER BY domain, path, name`
+
+	// a _ in site matches any character, the jar filters what it sends
+	rows, err := db.QueryContext(ctx, query, site, "%."+site)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanCookies(rows)
+}
+
+func SetCookie(ctx context.Context, c Cookie, db *sql.Tx) error {
+	const query = `INSERT INTO cookie (domain, path, name, value, host_only, secure, http_only, expires, updated_at) VALUES(?,?,?,?,?,?,?,?,?)
+    ON CONFLICT (domain, path, name) DO UPDATE SET value=excluded.value, host_only=excluded.host_only, secure=excluded.secure, http_only=excluded.http_only, expires=excluded.expires, updated_at=excluded.updated_at`
+	_, err := db.ExecContext(ctx, query, c.Domain, c.Path, c.Name, c.Value, c.HostOnly, c.Secure, c.HTTPOnly, c.Expires, time.Now())
+	return err
+}
+
+func DeleteCookie(ctx context.Context, c Cookie, db *sql.Tx) error {
+	const query = `DELETE FROM cookie WHERE domain=? AND path=? AND name=?`
+	_, err := db.ExecContext(ctx, query, c.Domain, c.Path, c.Name)
+	return err
+}
+
+// DeleteCookies clears the cookies that would be sent to host.
+func DeleteCookies(ctx context.Context, host string, db *sql.Tx) error {
+	domains := CookieDomains(host)
+
+	query := `DELETE FROM cookie WHERE domain IN (?` + strings.Repeat(",?", len(domains)-1) + `)`
+
+	args := make([]interface{}, len(domains))
+	for i, d := range domains {
+		args[i] = d
+	}
+
+	_, err := db.ExecContext(ctx, query, args...)
+	return err
+}
+
+func PruneCookies(ctx context.Context, now time.Time, db *sql.Tx) error {
+	const query = `DELETE FROM cookie WHERE expires IS NOT NULL AND expires <= ?`
+	_, err := db.ExecContext(ctx, query, now)
+	return err
+}
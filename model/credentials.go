@@ -0,0 +1,44 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// StoredCredentials is what the API reports about a feed's credentials.
+// The secret itself is only ever stored encrypted and is never returned.
+type StoredCredentials struct {
+	Kind       string     `json:"kind"`
+	Configured bool       `json:"configured"`
+	UpdatedAt  *time.Time `json:"updated_at,omitempty"`
+	Data       []byte     `json:"-"`
+}
+
+func (f Feed) GetCredentials(ctx context.Context, db *sql.Tx) (StoredCredentials, error) {
+	const query = `SELECT kind, data, updated_at FROM feed_credential WHERE feed=?`
+	var c StoredCredentials
+
+	err := db.QueryRowContext(ctx, query, f.ID).Scan(&c.Kind, &c.Data, &c.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return c, nil
+	} else if err != nil {
+		return c, err
+	}
+
+	c.Configured = true
+	return c, nil
+}
+
+func (f Feed) SetCredentials(ctx context.Context, kind string, data []byte, db *sql.Tx) error {
+	const query = `INSERT INTO feed_credential (feed, kind, data, updated_at) VALUES(?,?,?,?)
+    ON CONFLICT (feed) DO UPDATE SET kind=excluded.kind, data=excluded.data, updated_at=excluded.updated_at`
+	_, err := db.ExecContext(ctx, query, f.ID, kind, data, time.Now())
+	return err
+}
+
+func (f Feed) DeleteCredentials(ctx context.Context, db *sql.Tx) error {
+	const query = `DELETE FROM feed_credential WHERE feed=?`
+	_, err := db.ExecContext(ctx, query, f.ID)
+	return err
+}
@@ -0,0 +1,31 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+func (f Feed) RecordFailure(ctx context.Context, class string, msg string, status string, db *sql.Tx) error {
+	const query = `UPDATE feed SET failure_count=failure_count+1, last_error=?, last_error_class=?, last_error_at=?, status=? WHERE id=?`
+	_, err := db.ExecContext(ctx, query, msg, class, time.Now(), status, f.ID)
+	return err
+}
+
+func (f Feed) ClearFailures(ctx context.Context, db *sql.Tx) error {
+	const query = `UPDATE feed SET failure_count=0, status=? WHERE id=? AND (failure_count > 0 OR status != ?)`
+	_, err := db.ExecContext(ctx, query, StatusActive, f.ID, StatusActive)
+	return err
+}
+
+func (f Feed) SetStatus(ctx context.Context, status string, db *sql.Tx) error {
+	const query = `UPDATE feed SET status=? WHERE id=?`
+	_, err := db.ExecContext(ctx, query, status, f.ID)
+	return err
+}
+
+func FindBrokenFeeds(ctx context.Context, db *sql.Tx) ([]Feed, error) {
+	const query = `SELECT ` + feedColumns + ` FROM feed WHERE failure_count > 0 OR status != ? ORDER BY failure_count DESC, id`
+
+	return queryFeeds(ctx, db, query, StatusActive)
+}
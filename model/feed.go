@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/sha1"
 	"database/sql"
+	"errors"
 	"fmt"
 	"time"
 
@@ -16,6 +17,46 @@ type Feed struct {
 	LastUpdate      *time.Time `json:"last_update"`
 	CreatedAt       time.Time  `json:"created_at"`
 	CurrentRevision string     `json:"current_revision"`
+	LastStatus      *int64     `json:"last_status"`
+	LastChangeAt    *time.Time `json:"last_change_at"`
+	Schedule        Schedule   `json:"schedule"`
+	Status          string     `json:"status"`
+	FailureCount    int64      `json:"failure_count"`
+	LastError       string     `json:"last_error,omitempty"`
+	LastErrorClass  string     `json:"last_error_class,omitempty"`
+	LastErrorAt     *time.Time `json:"last_error_at,omitempty"`
+	PodcastGUID     string     `json:"podcast_guid,omitempty"`
+	LeaseOwner      string     `json:"lease_owner,omitempty"`
+	LeaseExpires    *time.Time `json:"lease_expires,omitempty"`
+	Moves           []Move     `json:"moves,omitempty"`
+}
+
+const (
+	StatusActive    = "active"
+	StatusSuspended = "suspended"
+	StatusGone      = "gone"
+
+	// StatusDisallowed feeds are still scheduled so that they pick up
+	// changes to robots.txt, but are not fetched.
+	StatusDisallowed = "disallowed"
+)
+
+const feedColumns = `id, url, last_update, created_at, COALESCE(current_revision, ''), last_status, last_change_at,
+    next_check_at, check_interval, min_interval, max_interval, schedule_reason, hints, ignore_hints,
+    status, failure_count, last_error, last_error_class, last_error_at, podcast_guid, lease_owner, lease_expires`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanFeed(row scanner) (Feed, error) {
+	var f Feed
+	err := row.Scan(&f.ID, &f.URL, &f.LastUpdate, &f.CreatedAt, &f.CurrentRevision, &f.LastStatus, &f.LastChangeAt,
+		&f.Schedule.NextCheckAt, &f.Schedule.Interval, &f.Schedule.MinInterval, &f.Schedule.MaxInterval, &f.Schedule.Reason,
+		&f.Schedule.Hints, &f.Schedule.IgnoreHints,
+		&f.Status, &f.FailureCount, &f.LastError, &f.LastErrorClass, &f.LastErrorAt, &f.PodcastGUID,
+		&f.LeaseOwner, &f.LeaseExpires)
+	return f, err
 }
 
 type Revision struct {
@@ -25,56 +66,91 @@ type Revision struct {
 	ContentType   string    `json:"type"`
 	ContentLength string    `json:"length"`
 	Etag          string    `json:"etag"`
+	LastModified  string    `json:"last_modified"`
+	Charset       string    `json:"charset,omitempty"`
+	Transcoded    bool      `json:"transcoded"`
+	ParseError    string    `json:"parse_error,omitempty"`
 	CreatedAt     time.Time `json:"created_at"`
+
+	// RawDiff patches the stored text back into the body as fetched,
+	// before normalization rules, and is empty when no rule changed it.
+	RawDiff     string `json:"-"`
+	RawChecksum string `json:"raw_checksum,omitempty"`
+
+	// Suppressed counts the later fetches that differed from this
+	// revision only in what normalization removed.
+	Suppressed int `json:"suppressed"`
 }
 
-func (f Feed) GetRevision(ctx context.Context, id string, db *sql.Tx) (Revision, error) {
+const revisionColumns = `id, diff, checksum, etag, COALESCE(last_modified, ''), content_length, content_type, charset, transcoded, created_at, raw_diff, raw_checksum, suppressed`
 
-	const query = `SELECT id, diff, checksum, etag, content_length, content_type, created_at FROM history WHERE feed=? AND id=?`
+func scanRevision(row scanner) (Revision, error) {
 	var r Revision
+	err := row.Scan(&r.ID, &r.Diff, &r.Checksum, &r.Etag, &r.LastModified, &r.ContentLength, &r.ContentType, &r.Charset, &r.Transcoded, &r.CreatedAt, &r.RawDiff, &r.RawChecksum, &r.Suppressed)
+	return r, err
+}
 
-	if err := db.QueryRowContext(ctx, query, f.ID, id).Scan(&r.ID, &r.Diff, &r.Checksum, &r.Etag, &r.ContentLength, &r.ContentType, &r.CreatedAt); err != nil {
-		return r, err
-	}
+func (f Feed) GetRevision(ctx context.Context, id string, db *sql.Tx) (Revision, error) {
 
-	return r, nil
+	const query = `SELECT ` + revisionColumns + ` FROM history WHERE feed=? AND id=?`
+	return scanRevision(db.QueryRowContext(ctx, query, f.ID, id))
 }
 
 func GetFeed(ctx context.Context, id string, db *sql.Tx) (Feed, error) {
-	const query = `SELECT id, url, last_update, created_at, current_revision FROM feed WHERE id=?`
-	var f Feed
+	const query = `SELECT ` + feedColumns + ` FROM feed WHERE id=?`
 
-	if err := db.QueryRowContext(ctx, query, id).Scan(&f.ID, &f.URL, &f.LastUpdate, &f.CreatedAt, &f.CurrentRevision); err != nil {
+	f, err := scanFeed(db.QueryRowContext(ctx, query, id))
+	if err != nil {
 		return f, err
 	}
 
-	return f, nil
+	f.Moves, err = f.GetMoves(ctx, db)
+	return f, err
 }
 
 func (f Feed) GetCurrentRevision(ctx context.Context, db *sql.Tx) (Revision, error) {
-	const query = `SELECT id, diff, checksum, etag, content_length, content_type, created_at FROM history WHERE id=?`
-	var r Revision
+	const query = `SELECT ` + revisionColumns + ` FROM history WHERE id=?`
+	return scanRevision(db.QueryRowContext(ctx, query, f.CurrentRevision))
+}
+
+// FindStaleFeeds claims up to limit feeds that are due to be checked and
+// not leased by another owner. Claiming is a conditional update of each
+// row, so two scanners sharing a database never get the same feed.
+func FindStaleFeeds(ctx context.Context, now time.Time, limit int, owner string, lease time.Duration, tx *sql.Tx) ([]Feed, error) {
+	const query = `SELECT ` + feedColumns + ` FROM feed WHERE status IN (?,?) AND (next_check_at IS NULL OR next_check_at <= ?)
+    AND (lease_expires IS NULL OR lease_expires <= ? OR lease_owner=?) ORDER BY next_check_at LIMIT ?`
 
-	if err := db.QueryRowContext(ctx, query, f.CurrentRevision).Scan(&r.ID, &r.Diff, &r.Checksum, &r.Etag, &r.ContentLength, &r.ContentType, &r.CreatedAt); err != nil {
-		return r, err
+	feeds, err := queryFeeds(ctx, tx, query, StatusActive, StatusDisallowed, now, now, owner, limit)
+	if err != nil {
+		return nil, err
 	}
 
-	return r, nil
-}
+	var claimed []Feed
+	for _, f := range feeds {
+		ok, err := f.ClaimLease(ctx, owner, now, lease, tx)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			claimed = append(claimed, f)
+		}
+	}
 
-func FindStaleFeeds(ctx context.Context, d time.Duration, limit int, tx *sql.Tx) ([]Feed, error) {
-	const query = `SELECT id, url FROM feed WHERE last_update < ? LIMIT ?`
+	return claimed, nil
+}
 
-	t := time.Now().Add(-d)
-	rows, err := tx.QueryContext(ctx, query, t, limit)
+func queryFeeds(ctx context.Context, db *sql.Tx, query string, args ...interface{}) ([]Feed, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 
+	defer rows.Close()
+
 	var feeds []Feed
 	for rows.Next() {
-		var f Feed
-		if err := rows.Scan(&f.ID, &f.URL); err != nil {
+		f, err := scanFeed(rows)
+		if err != nil {
 			return nil, err
 		}
 		feeds = append(feeds, f)
@@ -107,28 +183,125 @@ func CreateFeed(ctx context.Context, url string, db *sql.Tx) (Feed, error) {
 		ID:        id,
 		URL:       url,
 		CreatedAt: now,
+		Status:    StatusActive,
 	}, nil
 }
 
-func (f Feed) CommitDiff(ctx context.Context, body string, etag string, contentType string, db *sql.Tx) (bool, error) {
-	current, err := f.BuildFeed(ctx, "", db)
-	if err != nil {
-		return false, err
-	}
+// ErrConcurrentCommit is returned when a change is committed to a feed
+// whose current revision moved on after the change was prepared.
+var ErrConcurrentCommit = errors.New("feed was updated since the change was prepared")
+
+// A Change is a new revision diffed against a base revision. Preparing it
+// needs no transaction, so the diff can be computed while the database
+// is free and committed quickly afterwards.
+type Change struct {
+	Base     string
+	Patch    string
+	Checksum string
+	Length   int
+	Inserted int
+	Deleted  int
+
+	// RawPatch and RawChecksum describe the body as fetched, when it
+	// differs from the normalized body that was diffed. Suppressed is
+	// set when only the raw body changed.
+	RawPatch    string
+	RawChecksum string
+	Suppressed  bool
+}
+
+// PrepareChange diffs body against current, the text of revision base.
+// The patch is empty if nothing changed.
+func PrepareChange(base string, current string, body string) Change {
+	c := Change{Base: base, Length: len(body)}
 
 	dmp := diffmatchpatch.New()
 	diffs := dmp.DiffMain(current, body, false)
 	patch := dmp.PatchMake(current, diffs)
 
 	if len(patch) == 0 {
-		return false, nil
+		return c
 	}
 
-	sum := sha1.Sum([]byte(body))
-	hex := fmt.Sprintf("%x", sum)
+	for _, d := range diffs {
+		switch d.Type {
+		case diffmatchpatch.DiffInsert:
+			c.Inserted += len(d.Text)
+		case diffmatchpatch.DiffDelete:
+			c.Deleted += len(d.Text)
+		}
+	}
 
-	const query = `INSERT INTO history (feed, diff, checksum, etag, content_type, content_length, created_at) VALUES(?,?,?,?,?,?,?)`
-	res, err := db.ExecContext(ctx, query, f.ID, dmp.PatchToText(patch), hex, etag, contentType, len(body), time.Now())
+	c.Patch = dmp.PatchToText(patch)
+	c.Checksum = fmt.Sprintf("%x", sha1.Sum([]byte(body)))
+	return c
+}
+
+// SetRaw records how the fetched body raw differs from body, the text the
+// change was prepared from.
+func (c *Change) SetRaw(body, raw string) {
+	if raw == body {
+		return
+	}
+
+	dmp := diffmatchpatch.New()
+	c.RawPatch = dmp.PatchToText(dmp.PatchMake(body, dmp.DiffMain(body, raw, false)))
+	c.RawChecksum = fmt.Sprintf("%x", sha1.Sum([]byte(raw)))
+}
+
+// RawBody rebuilds the body of rv as it was fetched from its stored text.
+func RawBody(rv Revision, text string) (string, error) {
+	if rv.RawDiff == "" {
+		return text, nil
+	}
+
+	dmp := diffmatchpatch.New()
+	patches, err := dmp.PatchFromText(rv.RawDiff)
+	if err != nil {
+		return "", err
+	}
+
+	raw, success := dmp.PatchApply(patches, text)
+	for i, s := range success {
+		if !s {
+			return "", fmt.Errorf("failed to apply patch: %v", patches[i])
+		}
+	}
+
+	return raw, nil
+}
+
+func (f Feed) HeadRevision(ctx context.Context, db *sql.Tx) (string, error) {
+	const query = `SELECT COALESCE(current_revision, '') FROM feed WHERE id=?`
+	var head string
+	err := db.QueryRowContext(ctx, query, f.ID).Scan(&head)
+	return head, err
+}
+
+// CommitChange stores a prepared change as the new current revision. It
+// fails with ErrConcurrentCommit if the base is no longer current.
+func (f Feed) CommitChange(ctx context.Context, c Change, rv Revision, db *sql.Tx) (bool, error) {
+	head, err := f.HeadRevision(ctx, db)
+	if err != nil {
+		return false, err
+	}
+
+	if head != c.Base {
+		return false, ErrConcurrentCommit
+	}
+
+	if c.Patch == "" {
+		if c.Suppressed && head != "" {
+			const suppressed = `UPDATE history SET suppressed=suppressed+1 WHERE id=? AND feed=?`
+			if _, err := db.ExecContext(ctx, suppressed, head, f.ID); err != nil {
+				return false, err
+			}
+		}
+		return false, f.UpdateValidators(ctx, rv.Etag, rv.LastModified, db)
+	}
+
+	const query = `INSERT INTO history (feed, diff, checksum, etag, last_modified, content_type, content_length, charset, transcoded, raw_diff, raw_checksum, created_at) VALUES(?,?,?,?,?,?,?,?,?,?,?,?)`
+	res, err := db.ExecContext(ctx, query, f.ID, c.Patch, c.Checksum, rv.Etag, rv.LastModified, rv.ContentType, c.Length, rv.Charset, rv.Transcoded, c.RawPatch, c.RawChecksum, time.Now())
 	if err != nil {
 		return false, err
 	}
@@ -146,8 +319,24 @@ func (f Feed) CommitDiff(ctx context.Context, body string, etag string, contentT
 }
 
 func (f Feed) UpdateCurrentRevision(ctx context.Context, revision int64, db *sql.Tx) error {
-	const query = `UPDATE feed SET current_revision=? WHERE id=?`
-	_, err := db.ExecContext(ctx, query, revision, f.ID)
+	const query = `UPDATE feed SET current_revision=?, last_change_at=? WHERE id=?`
+	_, err := db.ExecContext(ctx, query, revision, time.Now(), f.ID)
+	return err
+}
+
+func (f Feed) UpdateValidators(ctx context.Context, etag string, lastModified string, db *sql.Tx) error {
+	if f.CurrentRevision == "" {
+		return nil
+	}
+
+	const query = `UPDATE history SET etag=?, last_modified=? WHERE id=? AND feed=?`
+	_, err := db.ExecContext(ctx, query, etag, lastModified, f.CurrentRevision, f.ID)
+	return err
+}
+
+func (f Feed) MarkChecked(ctx context.Context, status int, db *sql.Tx) error {
+	const query = `UPDATE feed SET last_update=?, last_status=? WHERE id=?`
+	_, err := db.ExecContext(ctx, query, time.Now(), status, f.ID)
 	return err
 }
 
@@ -215,7 +404,8 @@ func (f Feed) BuildFeed(ctx context.Context, checksum string, db *sql.Tx) (strin
 }
 
 func (f Feed) History(ctx context.Context, db *sql.Tx) ([]Revision, error) {
-	const query = `SELECT id, checksum, created_at FROM history WHERE feed=?`
+	const query = `SELECT h.id, h.checksum, h.charset, h.transcoded, COALESCE(c.parse_error, ''), h.raw_checksum, h.suppressed, h.created_at FROM history h
+		LEFT JOIN feed_channel c ON c.feed=h.feed AND c.revision=h.id WHERE h.feed=?`
 	var (
 		revisions []Revision
 		err       error
@@ -228,7 +418,7 @@ func (f Feed) History(ctx context.Context, db *sql.Tx) ([]Revision, error) {
 
 	for rows.Next() {
 		var r Revision
-		if err := rows.Scan(&r.ID, &r.Checksum, &r.CreatedAt); err != nil {
+		if err := rows.Scan(&r.ID, &r.Checksum, &r.Charset, &r.Transcoded, &r.ParseError, &r.RawChecksum, &r.Suppressed, &r.CreatedAt); err != nil {
 			return nil, err
 		}
 		revisions = append(revisions, r)
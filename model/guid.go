@@ -0,0 +1,35 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+)
+
+func (f Feed) SetPodcastGUID(ctx context.Context, guid string, db *sql.Tx) error {
+	const query = `UPDATE feed SET podcast_guid=? WHERE id=?`
+	_, err := db.ExecContext(ctx, query, guid, f.ID)
+	return err
+}
+
+func FindFeedsByGUID(ctx context.Context, guid string, db *sql.Tx) ([]Feed, error) {
+	const query = `SELECT ` + feedColumns + ` FROM feed WHERE podcast_guid=? ORDER BY id`
+	return queryFeeds(ctx, db, query, guid)
+}
+
+// FindDuplicateFeeds groups feeds that announce the same podcast:guid.
+func FindDuplicateFeeds(ctx context.Context, db *sql.Tx) (map[string][]Feed, error) {
+	const query = `SELECT ` + feedColumns + ` FROM feed WHERE podcast_guid IN
+    (SELECT podcast_guid FROM feed WHERE podcast_guid != '' GROUP BY podcast_guid HAVING COUNT(*) > 1) ORDER BY id`
+
+	feeds, err := queryFeeds(ctx, db, query)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string][]Feed)
+	for _, f := range feeds {
+		groups[f.PodcastGUID] = append(groups[f.PodcastGUID], f)
+	}
+
+	return groups, nil
+}
@@ -0,0 +1,51 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type HostLimit struct {
+	Host     string  `json:"host"`
+	Rate     float64 `json:"rate"`
+	Burst    int     `json:"burst"`
+	MaxConns int     `json:"max_conns"`
+}
+
+func GetHostLimits(ctx context.Context, db *sql.Tx) ([]HostLimit, error) {
+	const query = `SELECT host, rate, burst, max_conns FROM host_limit`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var limits []HostLimit
+	for rows.Next() {
+		var l HostLimit
+		if err := rows.Scan(&l.Host, &l.Rate, &l.Burst, &l.MaxConns); err != nil {
+			return nil, err
+		}
+		limits = append(limits, l)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return limits, nil
+}
+
+func SetHostLimit(ctx context.Context, l HostLimit, db *sql.Tx) error {
+	const query = `INSERT INTO host_limit (host, rate, burst, max_conns, updated_at) VALUES(?,?,?,?,?)
+    ON CONFLICT (host) DO UPDATE SET rate=excluded.rate, burst=excluded.burst, max_conns=excluded.max_conns, updated_at=excluded.updated_at`
+	_, err := db.ExecContext(ctx, query, l.Host, l.Rate, l.Burst, l.MaxConns, time.Now())
+	return err
+}
+
+func DeleteHostLimit(ctx context.Context, host string, db *sql.Tx) error {
+	const query = `DELETE FROM host_limit WHERE host=?`
+	_, err := db.ExecContext(ctx, query, host)
+	return err
+}
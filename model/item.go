@@ -0,0 +1,440 @@
+package model
+
+import (
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Channel is the feed-level metadata parsed from one revision. A revision
+// that failed to parse has only ParseError set, and leaves the items as
+// they were.
+type Channel struct {
+	Revision    int64     `json:"revision"`
+	Format      string    `json:"format,omitempty"`
+	Title       string    `json:"title,omitempty"`
+	Link        string    `json:"link,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Language    string    `json:"language,omitempty"`
+	ItemCount   int       `json:"item_count"`
+	ParseError  string    `json:"parse_error,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type Enclosure struct {
+	URL    string `json:"url"`
+	Type   string `json:"type,omitempty"`
+	Length int64  `json:"length,omitempty"`
+}
+
+// Item is one version of an item. Key identifies the item across
+// revisions, and Revision is the revision this version first appeared in.
+type Item struct {
+	ID          int64      `json:"id"`
+	Key         string     `json:"key"`
+	Revision    int64      `json:"revision"`
+	GUID        string     `json:"guid,omitempty"`
+	Title       string     `json:"title,omitempty"`
+	Link        string     `json:"link,omitempty"`
+	PubDate     string     `json:"pub_date,omitempty"`
+	Published   *time.Time `json:"published,omitempty"`
+	Description string     `json:"description,omitempty"`
+	Content     string     `json:"content,omitempty"`
+	Author      string     `json:"author,omitempty"`
+	Enclosure   *Enclosure `json:"enclosure,omitempty"`
+	Categories  []string   `json:"categories,omitempty"`
+	Position    int        `json:"position"`
+	FirstSeen   time.Time  `json:"first_seen"`
+	CreatedAt   time.Time  `json:"created_at"`
+
+	// Raw is the item's XML as it appeared in a Format document, kept
+	// out of the checksum so only changes to the fields above count.
+	Raw    string `json:"-"`
+	Format string `json:"-"`
+
+	item int64
+}
+
+// IndexResult describes how the items of a revision differ from those of
+// the previous revision that parsed.
+type IndexResult struct {
+	Added         int
+	PreviousCount int
+
+	// Gone are the latest versions of the items that were in the previous
+	// revision but not this one, at their previous positions.
+	Gone []Item
+}
+
+// checksum covers the fields of a version, so an unchanged item is not
+// stored again.
+func (i Item) checksum() string {
+	v := i
+	v.ID, v.Revision, v.Position, v.CreatedAt = 0, 0, 0, time.Time{}
+	b, _ := json.Marshal(v)
+	return fmt.Sprintf("%x", sha1.Sum(b))
+}
+
+const itemColumns = `v.id, v.item, i.key, v.revision, v.guid, v.title, v.link, v.pub_date, v.published, v.description, v.content, v.author, v.enclosure_url, v.enclosure_type, v.enclosure_length, i.position, i.created_at, v.created_at, v.raw, v.format`
+
+// scanItem reads itemColumns, and then any columns selected after them
+// into extra.
+func scanItem(row scanner, extra ...interface{}) (Item, error) {
+	var (
+		i Item
+		e Enclosure
+	)
+
+	dest := []interface{}{&i.ID, &i.item, &i.Key, &i.Revision, &i.GUID, &i.Title, &i.Link, &i.PubDate, &i.Published, &i.Description, &i.Content, &i.Author, &e.URL, &e.Type, &e.Length, &i.Position, &i.FirstSeen, &i.CreatedAt, &i.Raw, &i.Format}
+	err := row.Scan(append(dest, extra...)...)
+	if e.URL != "" {
+		i.Enclosure = &e
+	}
+
+	return i, err
+}
+
+func queryItems(ctx context.Context, db *sql.Tx, query string, args ...interface{}) ([]Item, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	items := []Item{}
+	for rows.Next() {
+		i, err := scanItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return items, itemCategories(ctx, items, db)
+}
+
+func itemCategories(ctx context.Context, items []Item, db *sql.Tx) error {
+	const query = `SELECT category FROM item_category WHERE version=? ORDER BY rowid`
+
+	for n := range items {
+		rows, err := db.QueryContext(ctx, query, items[n].ID)
+		if err != nil {
+			return err
+		}
+
+		for rows.Next() {
+			var c string
+			if err := rows.Scan(&c); err != nil {
+				rows.Close()
+				return err
+			}
+			items[n].Categories = append(items[n].Categories, c)
+		}
+
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LastIndexedRevision is the newest revision whose items have been parsed,
+// or 0 if none have.
+func (f Feed) LastIndexedRevision(ctx context.Context, db *sql.Tx) (int64, error) {
+	const query = `SELECT COALESCE(MAX(revision), 0) FROM feed_channel WHERE feed=?`
+	var id int64
+	err := db.QueryRowContext(ctx, query, f.ID).Scan(&id)
+	return id, err
+}
+
+// FindUnindexedFeeds returns the feeds whose current revision has not been
+// parsed into items, such as feeds archived before items were.
+func FindUnindexedFeeds(ctx context.Context, db *sql.Tx) ([]Feed, error) {
+	const query = `SELECT ` + feedColumns + ` FROM feed WHERE current_revision >
+    (SELECT COALESCE(MAX(c.revision), 0) FROM feed_channel c WHERE c.feed=feed.id)`
+	return queryFeeds(ctx, db, query)
+}
+
+// IndexRevision records the channel and items parsed from rv. Items are
+// matched to earlier revisions by key, and a new version is only stored
+// when something in it changed. An item that comes back is no longer
+// counted as removed.
+func (f Feed) IndexRevision(ctx context.Context, rv Revision, ch Channel, items []Item, db *sql.Tx) (IndexResult, error) {
+	const previous = `SELECT COALESCE(MAX(revision), 0) FROM feed_channel WHERE feed=? AND parse_error IS NULL AND revision<?`
+
+	var (
+		res  IndexResult
+		prev int64
+	)
+
+	if err := db.QueryRowContext(ctx, previous, f.ID, rv.ID).Scan(&prev); err != nil {
+		return res, err
+	}
+
+	const channel = `INSERT INTO feed_channel (feed, revision, format, title, link, description, language, item_count, parse_error, created_at) VALUES(?,?,?,?,?,?,?,?,?,?)
+    ON CONFLICT (feed, revision) DO UPDATE SET format=excluded.format, title=excluded.title, link=excluded.link, description=excluded.description, language=excluded.language, item_count=excluded.item_count, parse_error=excluded.parse_error, created_at=excluded.created_at`
+
+	var parseError *string
+	if ch.ParseError != "" {
+		parseError = &ch.ParseError
+	}
+
+	if _, err := db.ExecContext(ctx, channel, f.ID, rv.ID, ch.Format, ch.Title, ch.Link, ch.Description, ch.Language, len(items), parseError, rv.CreatedAt); err != nil {
+		return res, err
+	}
+
+	if parseError != nil {
+		return res, nil
+	}
+
+	const (
+		lookup  = `SELECT id, last_revision FROM item WHERE feed=? AND key=?`
+		create  = `INSERT INTO item (feed, key, first_revision, last_revision, position, created_at) VALUES(?,?,?,?,?,?)`
+		update  = `UPDATE item SET last_revision=?, position=? WHERE id=?`
+		latest  = `SELECT checksum FROM item_version WHERE item=? ORDER BY id DESC LIMIT 1`
+		version = `INSERT INTO item_version (item, revision, checksum, guid, title, link, pub_date, published, description, content, author, enclosure_url, enclosure_type, enclosure_length, raw, format, created_at) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`
+		categ   = `INSERT INTO item_category (version, category) VALUES(?,?)`
+		restore = `UPDATE item_removal SET restored_revision=? WHERE item=? AND restored_revision IS NULL`
+		gone    = `SELECT ` + itemColumns + ` FROM item i JOIN item_version v ON v.id=(SELECT MAX(id) FROM item_version WHERE item=i.id) WHERE i.feed=? AND i.last_revision=? ORDER BY i.position`
+	)
+
+	seen := make(map[string]bool)
+	for pos, i := range items {
+		// a feed listing the same item twice keeps the first
+		if i.Key == "" || seen[i.Key] {
+			continue
+		}
+		seen[i.Key] = true
+
+		var id, last int64
+		err := db.QueryRowContext(ctx, lookup, f.ID, i.Key).Scan(&id, &last)
+		if err == sql.ErrNoRows {
+			r, err := db.ExecContext(ctx, create, f.ID, i.Key, rv.ID, rv.ID, pos, rv.CreatedAt)
+			if err != nil {
+				return res, err
+			}
+			if id, err = r.LastInsertId(); err != nil {
+				return res, err
+			}
+			res.Added++
+		} else if err != nil {
+			return res, err
+		} else {
+			if _, err := db.ExecContext(ctx, update, rv.ID, pos, id); err != nil {
+				return res, err
+			}
+			if last == prev {
+				res.PreviousCount++
+			} else if _, err := db.ExecContext(ctx, restore, rv.ID, id); err != nil {
+				return res, err
+			}
+		}
+
+		sum := i.checksum()
+
+		var latestSum string
+		if err := db.QueryRowContext(ctx, latest, id).Scan(&latestSum); err != nil && err != sql.ErrNoRows {
+			return res, err
+		}
+		if latestSum == sum {
+			continue
+		}
+
+		var e Enclosure
+		if i.Enclosure != nil {
+			e = *i.Enclosure
+		}
+
+		r, err := db.ExecContext(ctx, version, id, rv.ID, sum, i.GUID, i.Title, i.Link, i.PubDate, i.Published, i.Description, i.Content, i.Author, e.URL, e.Type, e.Length, i.Raw, ch.Format, rv.CreatedAt)
+		if err != nil {
+			return res, err
+		}
+
+		vid, err := r.LastInsertId()
+		if err != nil {
+			return res, err
+		}
+
+		for _, c := range i.Categories {
+			if _, err := db.ExecContext(ctx, categ, vid, c); err != nil {
+				return res, err
+			}
+		}
+	}
+
+	if prev == 0 {
+		return res, nil
+	}
+
+	// whatever still points at the previous revision was not in this one
+	var err error
+	if res.Gone, err = queryItems(ctx, db, gone, f.ID, prev); err != nil {
+		return res, err
+	}
+	res.PreviousCount += len(res.Gone)
+
+	return res, nil
+}
+
+// CurrentChannel is the channel of the newest revision that parsed, and
+// the parse error of the newest revision if it did not.
+func (f Feed) CurrentChannel(ctx context.Context, db *sql.Tx) (Channel, string, error) {
+	const query = `SELECT revision, format, title, link, description, language, item_count, COALESCE(parse_error, ''), created_at FROM feed_channel WHERE feed=? AND (parse_error IS NULL OR revision=(SELECT MAX(revision) FROM feed_channel WHERE feed=?)) ORDER BY revision DESC LIMIT 2`
+
+	rows, err := db.QueryContext(ctx, query, f.ID, f.ID)
+	if err != nil {
+		return Channel{}, "", err
+	}
+
+	defer rows.Close()
+
+	var (
+		ch         Channel
+		parseError string
+	)
+
+	for rows.Next() {
+		var c Channel
+		if err := rows.Scan(&c.Revision, &c.Format, &c.Title, &c.Link, &c.Description, &c.Language, &c.ItemCount, &c.ParseError, &c.CreatedAt); err != nil {
+			return ch, "", err
+		}
+		if c.ParseError != "" {
+			parseError = c.ParseError
+			continue
+		}
+		ch = c
+		break
+	}
+
+	return ch, parseError, rows.Err()
+}
+
+// CurrentItems returns the latest version of each item in the newest
+// revision that parsed, in feed order.
+func (f Feed) CurrentItems(ctx context.Context, db *sql.Tx) ([]Item, error) {
+	const query = `SELECT ` + itemColumns + ` FROM item i JOIN item_version v ON v.id=(SELECT MAX(id) FROM item_version WHERE item=i.id)
+		WHERE i.feed=? AND i.last_revision=(SELECT MAX(revision) FROM feed_channel WHERE feed=? AND parse_error IS NULL)
+		ORDER BY i.position`
+	return queryItems(ctx, db, query, f.ID, f.ID)
+}
+
+// DeleteItems drops everything parsed from the feed's revisions, so they
+// can be indexed again.
+func (f Feed) DeleteItems(ctx context.Context, db *sql.Tx) error {
+	queries := []string{
+		`DELETE FROM item_removal WHERE item IN (SELECT id FROM item WHERE feed=?)`,
+		`DELETE FROM item_category WHERE version IN (SELECT v.id FROM item_version v JOIN item i ON i.id=v.item WHERE i.feed=?)`,
+		`DELETE FROM item_version WHERE item IN (SELECT id FROM item WHERE feed=?)`,
+		`DELETE FROM item WHERE feed=?`,
+		`DELETE FROM feed_channel WHERE feed=?`,
+	}
+
+	for _, q := range queries {
+		if _, err := db.ExecContext(ctx, q, f.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FindItem looks an item up by key, or else by the link of any of its
+// versions, for items whose key is a guid the caller does not know.
+func (f Feed) FindItem(ctx context.Context, key string, db *sql.Tx) (int64, error) {
+	const (
+		byKey  = `SELECT id FROM item WHERE feed=? AND key=?`
+		byLink = `SELECT v.item FROM item_version v JOIN item i ON i.id=v.item WHERE i.feed=? AND v.link=? ORDER BY v.id DESC LIMIT 1`
+	)
+
+	var id int64
+	err := db.QueryRowContext(ctx, byKey, f.ID, key).Scan(&id)
+	if err == sql.ErrNoRows {
+		err = db.QueryRowContext(ctx, byLink, f.ID, key).Scan(&id)
+	}
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("no item %q in feed %d", key, f.ID)
+	}
+
+	return id, err
+}
+
+// AllItems returns the latest version of every item the feed has ever
+// listed, including those it no longer does.
+func (f Feed) AllItems(ctx context.Context, db *sql.Tx) ([]Item, error) {
+	const query = `SELECT ` + itemColumns + ` FROM item i JOIN item_version v ON v.id=(SELECT MAX(id) FROM item_version WHERE item=i.id) WHERE i.feed=?`
+	return queryItems(ctx, db, query, f.ID)
+}
+
+// ItemHistory returns every version of an item, oldest first.
+func (f Feed) ItemHistory(ctx context.Context, item int64, db *sql.Tx) ([]Item, error) {
+	const query = `SELECT ` + itemColumns + ` FROM item_version v JOIN item i ON i.id=v.item WHERE i.feed=? AND v.item=? ORDER BY v.id`
+	return queryItems(ctx, db, query, f.ID, item)
+}
+
+// Removal is an item that was deleted from the feed, with its last
+// version before it disappeared.
+type Removal struct {
+	Item      Item      `json:"item"`
+	Revision  int64     `json:"revision"`
+	RemovedAt time.Time `json:"removed_at"`
+}
+
+// RecordRemoval marks an item as deleted in revision rv.
+func (f Feed) RecordRemoval(ctx context.Context, i Item, rv Revision, db *sql.Tx) error {
+	const query = `INSERT INTO item_removal (item, version, revision, created_at) VALUES(?,?,?,?)`
+	_, err := db.ExecContext(ctx, query, i.item, i.ID, rv.ID, rv.CreatedAt)
+	return err
+}
+
+// Removals returns the items deleted from the feed that have not come
+// back since, most recently removed first.
+func (f Feed) Removals(ctx context.Context, db *sql.Tx) ([]Removal, error) {
+	const query = `SELECT ` + itemColumns + `, r.revision, r.created_at FROM item_removal r
+		JOIN item_version v ON v.id=r.version JOIN item i ON i.id=r.item
+		WHERE i.feed=? AND r.restored_revision IS NULL ORDER BY r.id DESC`
+
+	rows, err := db.QueryContext(ctx, query, f.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var (
+		removals []Removal
+		items    []Item
+	)
+
+	for rows.Next() {
+		var r Removal
+		if r.Item, err = scanItem(rows, &r.Revision, &r.RemovedAt); err != nil {
+			return nil, err
+		}
+		removals = append(removals, r)
+		items = append(items, r.Item)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := itemCategories(ctx, items, db); err != nil {
+		return nil, err
+	}
+
+	for n := range removals {
+		removals[n].Item = items[n]
+	}
+
+	return removals, nil
+}
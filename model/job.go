@@ -0,0 +1,196 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+const (
+	JobPending = "pending"
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// Jobs are refreshes somebody asked for. They run ahead of scheduled
+// checks, and among themselves by priority.
+const (
+	PriorityCreated = 10
+	PriorityManual  = 20
+)
+
+type Job struct {
+	ID         int64      `json:"id"`
+	Feed       int64      `json:"feed"`
+	Priority   int        `json:"priority"`
+	Reason     string     `json:"reason"`
+	Status     string     `json:"status"`
+	Owner      string     `json:"owner,omitempty"`
+	Changed    bool       `json:"changed"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ClaimedAt  *time.Time `json:"claimed_at,omitempty"`
+	StartedAt  *time.Time `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+}
+
+func (j Job) Finished() bool {
+	return j.Status == JobDone || j.Status == JobFailed
+}
+
+const jobColumns = `id, feed, priority, reason, status, owner, changed, error, created_at, started_at, finished_at, claimed_at`
+
+func scanJob(row scanner) (Job, error) {
+	var j Job
+	err := row.Scan(&j.ID, &j.Feed, &j.Priority, &j.Reason, &j.Status, &j.Owner, &j.Changed, &j.Error, &j.CreatedAt, &j.StartedAt, &j.FinishedAt, &j.ClaimedAt)
+	return j, err
+}
+
+func queryJobs(ctx context.Context, db *sql.Tx, query string, args ...interface{}) ([]Job, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var jobs []Job
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+
+	return jobs, rows.Err()
+}
+
+func GetJob(ctx context.Context, id string, db *sql.Tx) (Job, error) {
+	const query = `SELECT ` + jobColumns + ` FROM job WHERE id=?`
+	return scanJob(db.QueryRowContext(ctx, query, id))
+}
+
+// EnqueueJob adds a refresh of a feed, unless one is already pending or
+// queued, in which case that job is returned with its priority raised if
+// needed. A queued job has not fetched anything yet, so it serves the new
+// request as well.
+func EnqueueJob(ctx context.Context, feed int64, priority int, reason string, db *sql.Tx) (Job, error) {
+	const pending = `SELECT ` + jobColumns + ` FROM job WHERE feed=? AND status IN (?,?) ORDER BY id LIMIT 1`
+
+	j, err := scanJob(db.QueryRowContext(ctx, pending, feed, JobPending, JobQueued))
+	if err == nil {
+		if priority > j.Priority {
+			const update = `UPDATE job SET priority=?, reason=? WHERE id=?`
+			if _, err := db.ExecContext(ctx, update, priority, reason, j.ID); err != nil {
+				return j, err
+			}
+			j.Priority, j.Reason = priority, reason
+		}
+		return j, nil
+	} else if err != sql.ErrNoRows {
+		return j, err
+	}
+
+	j = Job{Feed: feed, Priority: priority, Reason: reason, Status: JobPending, CreatedAt: time.Now()}
+
+	const insert = `INSERT INTO job (feed, priority, reason, status, created_at) VALUES(?,?,?,?,?)`
+	res, err := db.ExecContext(ctx, insert, j.Feed, j.Priority, j.Reason, j.Status, j.CreatedAt)
+	if err != nil {
+		return j, err
+	}
+
+	j.ID, err = res.LastInsertId()
+	return j, err
+}
+
+// ClaimJobs queues up to limit jobs for owner, highest priority first.
+// A queued job is not running yet, it may still wait behind host limits
+// until Start. Jobs left queued or running since before stale are claimed
+// again, since whoever held them has gone away.
+func ClaimJobs(ctx context.Context, owner string, now time.Time, stale time.Time, limit int, db *sql.Tx) ([]Job, error) {
+	const query = `SELECT ` + jobColumns + ` FROM job WHERE status=? OR (status=? AND claimed_at <= ?) OR (status=? AND started_at <= ?)
+    ORDER BY priority DESC, id LIMIT ?`
+
+	jobs, err := queryJobs(ctx, db, query, JobPending, JobQueued, stale, JobRunning, stale, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	const claim = `UPDATE job SET status=?, owner=?, claimed_at=?, started_at=NULL WHERE id=?
+    AND (status=? OR (status=? AND claimed_at <= ?) OR (status=? AND started_at <= ?))`
+
+	var claimed []Job
+	for _, j := range jobs {
+		res, err := db.ExecContext(ctx, claim, JobQueued, owner, now, j.ID, JobPending, JobQueued, stale, JobRunning, stale)
+		if err != nil {
+			return nil, err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return nil, err
+		} else if n == 1 {
+			j.Status, j.Owner, j.ClaimedAt, j.StartedAt = JobQueued, owner, &now, nil
+			claimed = append(claimed, j)
+		}
+	}
+
+	return claimed, nil
+}
+
+// Start marks a job queued for owner as running. It reports false if the
+// job was claimed by someone else in the meantime.
+func (j *Job) Start(ctx context.Context, owner string, now time.Time, db *sql.Tx) (bool, error) {
+	const query = `UPDATE job SET status=?, started_at=? WHERE id=? AND status=? AND owner=?`
+
+	res, err := db.ExecContext(ctx, query, JobRunning, now, j.ID, JobQueued, owner)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil || n != 1 {
+		return false, err
+	}
+
+	j.Status, j.StartedAt = JobRunning, &now
+	return true, nil
+}
+
+// Release puts a claimed job back in the queue without running it. A job
+// claimed again by someone else since is left alone.
+func (j Job) Release(ctx context.Context, db *sql.Tx) error {
+	const query = `UPDATE job SET status=?, owner='', claimed_at=NULL, started_at=NULL
+    WHERE id=? AND status IN (?,?) AND owner=? AND claimed_at=?`
+	_, err := db.ExecContext(ctx, query, JobPending, j.ID, JobQueued, JobRunning, j.Owner, j.ClaimedAt)
+	return err
+}
+
+// Finish records the outcome of a job claimed by its owner. It reports
+// false if the claim expired and the job was claimed again since, so a
+// late worker cannot overwrite the newer run.
+func (j Job) Finish(ctx context.Context, changed bool, msg string, db *sql.Tx) (bool, error) {
+	status := JobDone
+	if msg != "" {
+		status = JobFailed
+	}
+
+	const query = `UPDATE job SET status=?, changed=?, error=?, finished_at=?
+    WHERE id=? AND status IN (?,?) AND owner=? AND claimed_at=?`
+
+	res, err := db.ExecContext(ctx, query, status, changed, msg, time.Now(), j.ID, JobQueued, JobRunning, j.Owner, j.ClaimedAt)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// PruneJobs deletes jobs that finished before t.
+func PruneJobs(ctx context.Context, t time.Time, db *sql.Tx) error {
+	const query = `DELETE FROM job WHERE status IN (?,?) AND finished_at < ?`
+	_, err := db.ExecContext(ctx, query, JobDone, JobFailed, t)
+	return err
+}
@@ -0,0 +1,33 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// ClaimLease takes or extends the lease on a feed for owner, unless
+// another owner holds one that has not expired. It reports whether the
+// lease is now held by owner.
+func (f Feed) ClaimLease(ctx context.Context, owner string, now time.Time, lease time.Duration, db *sql.Tx) (bool, error) {
+	const query = `UPDATE feed SET lease_owner=?, lease_expires=? WHERE id=?
+    AND (lease_expires IS NULL OR lease_expires <= ? OR lease_owner=?)`
+
+	res, err := db.ExecContext(ctx, query, owner, now.Add(lease), f.ID, now, owner)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+func (f Feed) ReleaseLease(ctx context.Context, owner string, db *sql.Tx) error {
+	const query = `UPDATE feed SET lease_owner='', lease_expires=NULL WHERE id=? AND lease_owner=?`
+	_, err := db.ExecContext(ctx, query, f.ID, owner)
+	return err
+}
@@ -0,0 +1,183 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// RevisionBody is a revision along with its full text.
+type RevisionBody struct {
+	Revision
+	Body string
+}
+
+// Replay rebuilds every revision of the feed in order, with its full body.
+func (f Feed) Replay(ctx context.Context, db *sql.Tx) ([]RevisionBody, error) {
+	const query = `SELECT ` + revisionColumns + ` FROM history WHERE feed=? ORDER BY id`
+
+	rows, err := db.QueryContext(ctx, query, f.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var (
+		revisions []RevisionBody
+		body      string
+	)
+
+	dmp := diffmatchpatch.New()
+
+	for rows.Next() {
+		rv, err := scanRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		r := RevisionBody{Revision: rv}
+
+		patches, err := dmp.PatchFromText(r.Diff)
+		if err != nil {
+			return nil, err
+		}
+
+		var success []bool
+		body, success = dmp.PatchApply(patches, body)
+		for i, s := range success {
+			if !s {
+				return nil, fmt.Errorf("failed to apply patch: %v", patches[i])
+			}
+		}
+
+		r.Body = body
+		revisions = append(revisions, r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return revisions, nil
+}
+
+// MergeFeeds folds the history of from into f. Both histories are replayed,
+// interleaved by capture time and stored again as a single chain of diffs
+// on f, so revision ids of both feeds change. from is deleted and its URLs
+// become aliases of f. Parsed items of both feeds are dropped.
+func MergeFeeds(ctx context.Context, f Feed, from Feed, db *sql.Tx) error {
+	if f.ID == from.ID {
+		return fmt.Errorf("cannot merge feed %d into itself", f.ID)
+	}
+
+	ours, err := f.Replay(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	theirs, err := from.Replay(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	revisions := append(ours, theirs...)
+	sort.SliceStable(revisions, func(i, j int) bool {
+		return revisions[i].CreatedAt.Before(revisions[j].CreatedAt)
+	})
+
+	if _, err := db.ExecContext(ctx, `DELETE FROM history WHERE feed IN (?,?)`, f.ID, from.ID); err != nil {
+		return err
+	}
+
+	// parsed items point at the old revision ids, and are indexed again
+	// from the merged history
+	for _, feed := range []Feed{f, from} {
+		if err := feed.DeleteItems(ctx, db); err != nil {
+			return err
+		}
+	}
+
+	const insert = `INSERT INTO history (feed, diff, checksum, etag, last_modified, content_type, content_length, charset, transcoded, raw_diff, raw_checksum, suppressed, created_at) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?)`
+
+	var (
+		prev    string
+		current int64
+	)
+
+	dmp := diffmatchpatch.New()
+
+	for _, r := range revisions {
+		diffs := dmp.DiffMain(prev, r.Body, false)
+		patch := dmp.PatchMake(prev, diffs)
+		if len(patch) == 0 {
+			continue
+		}
+
+		res, err := db.ExecContext(ctx, insert, f.ID, dmp.PatchToText(patch), r.Checksum, r.Etag, r.LastModified, r.ContentType, r.ContentLength, r.Charset, r.Transcoded, r.RawDiff, r.RawChecksum, r.Suppressed, r.CreatedAt)
+		if err != nil {
+			return err
+		}
+
+		if current, err = res.LastInsertId(); err != nil {
+			return err
+		}
+
+		prev = r.Body
+	}
+
+	if current != 0 {
+		if _, err := db.ExecContext(ctx, `UPDATE feed SET current_revision=? WHERE id=?`, current, f.ID); err != nil {
+			return err
+		}
+	}
+
+	const (
+		aliases = `UPDATE feed_url SET feed=? WHERE feed=?`
+		alias   = `INSERT INTO feed_url (feed, url, new_url, reason, created_at) VALUES(?,?,?,?,?)`
+	)
+
+	if _, err := db.ExecContext(ctx, aliases, f.ID, from.ID); err != nil {
+		return err
+	}
+
+	reason := fmt.Sprintf("merged from feed %d", from.ID)
+	if _, err := db.ExecContext(ctx, alias, f.ID, from.URL, f.URL, reason, time.Now()); err != nil {
+		return err
+	}
+
+	if _, err := db.ExecContext(ctx, `DELETE FROM fetch_options WHERE feed=?`, from.ID); err != nil {
+		return err
+	}
+
+	if _, err := db.ExecContext(ctx, `DELETE FROM feed_credential WHERE feed=?`, from.ID); err != nil {
+		return err
+	}
+
+	if _, err := db.ExecContext(ctx, `DELETE FROM feed_move_refusal WHERE feed=?`, from.ID); err != nil {
+		return err
+	}
+
+	if _, err := db.ExecContext(ctx, `DELETE FROM normalize_rules WHERE feed=?`, from.ID); err != nil {
+		return err
+	}
+
+	if _, err := db.ExecContext(ctx, `DELETE FROM tls_option WHERE scope=? AND target=?`, TLSScopeFeed, from.TLSTarget()); err != nil {
+		return err
+	}
+
+	if _, err := db.ExecContext(ctx, `DELETE FROM websub_subscription WHERE feed=?`, from.ID); err != nil {
+		return err
+	}
+
+	if _, err := db.ExecContext(ctx, `DELETE FROM job WHERE feed=?`, from.ID); err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, `DELETE FROM feed WHERE id=?`, from.ID)
+	return err
+}
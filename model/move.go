@@ -0,0 +1,86 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type Move struct {
+	URL       string    `json:"url"`
+	NewURL    string    `json:"new_url"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// GetFeedByURL finds a feed by its current URL or any URL it was
+// previously known by.
+func GetFeedByURL(ctx context.Context, url string, db *sql.Tx) (Feed, error) {
+	const query = `SELECT id FROM feed WHERE url=? UNION ALL SELECT feed FROM feed_url WHERE url=? LIMIT 1`
+
+	var id string
+	if err := db.QueryRowContext(ctx, query, url, url).Scan(&id); err != nil {
+		return Feed{}, err
+	}
+
+	return GetFeed(ctx, id, db)
+}
+
+func (f Feed) GetMoves(ctx context.Context, db *sql.Tx) ([]Move, error) {
+	const query = `SELECT url, new_url, reason, created_at FROM feed_url WHERE feed=? ORDER BY id`
+
+	rows, err := db.QueryContext(ctx, query, f.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var moves []Move
+	for rows.Next() {
+		var m Move
+		if err := rows.Scan(&m.URL, &m.NewURL, &m.Reason, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		moves = append(moves, m)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return moves, nil
+}
+
+// MoveURL changes the feed's canonical URL, keeping the old one as an alias.
+func (f Feed) MoveURL(ctx context.Context, url string, reason string, db *sql.Tx) error {
+	const (
+		update = `UPDATE feed SET url=? WHERE id=?`
+		insert = `INSERT INTO feed_url (feed, url, new_url, reason, created_at) VALUES(?,?,?,?,?)`
+	)
+
+	if _, err := db.ExecContext(ctx, update, url, f.ID); err != nil {
+		return err
+	}
+
+	_, err := db.ExecContext(ctx, insert, f.ID, f.URL, url, reason, time.Now())
+	return err
+}
+
+// MoveRefused reports whether a move of the feed to url was refused
+// before, so it is not confirmed again on every check.
+func (f Feed) MoveRefused(ctx context.Context, url string, db *sql.Tx) (bool, error) {
+	const query = `SELECT COUNT(*) FROM feed_move_refusal WHERE feed=? AND url=?`
+
+	var n int
+	if err := db.QueryRowContext(ctx, query, f.ID, url).Scan(&n); err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+func (f Feed) RefuseMove(ctx context.Context, url string, reason string, db *sql.Tx) error {
+	const query = `INSERT INTO feed_move_refusal (feed, url, reason, created_at) VALUES(?,?,?,?)
+    ON CONFLICT (feed, url) DO UPDATE SET reason=excluded.reason`
+	_, err := db.ExecContext(ctx, query, f.ID, url, reason, time.Now())
+	return err
+}
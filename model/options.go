@@ -0,0 +1,44 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type FetchOptions struct {
+	UserAgent   string `json:"user_agent"`
+	Proxy       string `json:"proxy"`
+	Timeout     int64  `json:"timeout"`
+	MaxBodySize int64  `json:"max_body_size"`
+
+	// IgnoreRobots is for feeds the operator has permission to archive.
+	IgnoreRobots bool `json:"ignore_robots"`
+
+	// Cookies keeps the cookies a feed's server sets, for feeds that
+	// only serve content after a consent or bot check redirect.
+	Cookies bool `json:"cookies"`
+}
+
+func (o FetchOptions) TimeoutDuration() time.Duration {
+	return time.Duration(o.Timeout) * time.Second
+}
+
+func (f Feed) GetFetchOptions(ctx context.Context, db *sql.Tx) (FetchOptions, error) {
+	const query = `SELECT user_agent, proxy, timeout, max_body_size, ignore_robots, cookies FROM fetch_options WHERE feed=?`
+	var o FetchOptions
+
+	err := db.QueryRowContext(ctx, query, f.ID).Scan(&o.UserAgent, &o.Proxy, &o.Timeout, &o.MaxBodySize, &o.IgnoreRobots, &o.Cookies)
+	if err == sql.ErrNoRows {
+		return o, nil
+	}
+
+	return o, err
+}
+
+func (f Feed) SetFetchOptions(ctx context.Context, o FetchOptions, db *sql.Tx) error {
+	const query = `INSERT INTO fetch_options (feed, user_agent, proxy, timeout, max_body_size, ignore_robots, cookies, updated_at) VALUES(?,?,?,?,?,?,?,?)
+    ON CONFLICT (feed) DO UPDATE SET user_agent=excluded.user_agent, proxy=excluded.proxy, timeout=excluded.timeout, max_body_size=excluded.max_body_size, ignore_robots=excluded.ignore_robots, cookies=excluded.cookies, updated_at=excluded.updated_at`
+	_, err := db.ExecContext(ctx, query, f.ID, o.UserAgent, o.Proxy, o.Timeout, o.MaxBodySize, o.IgnoreRobots, o.Cookies, time.Now())
+	return err
+}
@@ -0,0 +1,66 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+const (
+	RuleRemove     = "remove"
+	RuleReplace    = "replace"
+	RuleStripQuery = "strip_query"
+)
+
+// A NormalizeRule removes noise from a fetched body before it is diffed.
+// Remove drops the elements at Path, Replace substitutes Replacement for
+// matches of the regular expression Pattern, and StripQuery drops the
+// named query parameters from URLs.
+type NormalizeRule struct {
+	Kind        string   `json:"kind"`
+	Path        string   `json:"path,omitempty"`
+	Pattern     string   `json:"pattern,omitempty"`
+	Replacement string   `json:"replacement,omitempty"`
+	Params      []string `json:"params,omitempty"`
+}
+
+// GlobalRules is the feed id that rules for every feed are stored under.
+const GlobalRules = 0
+
+func GetNormalizeRules(ctx context.Context, feed int64, db *sql.Tx) ([]NormalizeRule, error) {
+	const query = `SELECT rules FROM normalize_rules WHERE feed=?`
+
+	var data string
+	err := db.QueryRowContext(ctx, query, feed).Scan(&data)
+	if err == sql.ErrNoRows {
+		return []NormalizeRule{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	rules := []NormalizeRule{}
+	if err := json.Unmarshal([]byte(data), &rules); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func SetNormalizeRules(ctx context.Context, feed int64, rules []NormalizeRule, db *sql.Tx) error {
+	data, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+
+	const query = `INSERT INTO normalize_rules (feed, rules, updated_at) VALUES(?,?,?)
+    ON CONFLICT (feed) DO UPDATE SET rules=excluded.rules, updated_at=excluded.updated_at`
+	_, err = db.ExecContext(ctx, query, feed, string(data), time.Now())
+	return err
+}
+
+func DeleteNormalizeRules(ctx context.Context, feed int64, db *sql.Tx) error {
+	const query = `DELETE FROM normalize_rules WHERE feed=?`
+	_, err := db.ExecContext(ctx, query, feed)
+	return err
+}
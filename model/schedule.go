@@ -0,0 +1,62 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+type Schedule struct {
+	NextCheckAt *time.Time `json:"next_check_at"`
+	Interval    int64      `json:"interval"`
+	MinInterval int64      `json:"min_interval"`
+	MaxInterval int64      `json:"max_interval"`
+	Reason      string     `json:"reason"`
+	Hints       Hints      `json:"hints"`
+	IgnoreHints bool       `json:"ignore_hints"`
+}
+
+// Hints are the polling hints a publisher put in the feed body.
+type Hints struct {
+	TTL          int64    `json:"ttl,omitempty"`
+	UpdatePeriod int64    `json:"update_period,omitempty"`
+	SkipHours    []int    `json:"skip_hours,omitempty"`
+	SkipDays     []string `json:"skip_days,omitempty"`
+}
+
+func (h *Hints) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*h = Hints{}
+		return nil
+	case string:
+		return json.Unmarshal([]byte(v), h)
+	case []byte:
+		return json.Unmarshal(v, h)
+	default:
+		return fmt.Errorf("cannot scan %T into hints", src)
+	}
+}
+
+func (h Hints) Value() (driver.Value, error) {
+	b, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (f Feed) UpdateSchedule(ctx context.Context, s Schedule, db *sql.Tx) error {
+	const query = `UPDATE feed SET next_check_at=?, check_interval=?, schedule_reason=?, hints=? WHERE id=?`
+	_, err := db.ExecContext(ctx, query, s.NextCheckAt, s.Interval, s.Reason, s.Hints, f.ID)
+	return err
+}
+
+func (f Feed) SetScheduleOptions(ctx context.Context, s Schedule, db *sql.Tx) error {
+	const query = `UPDATE feed SET min_interval=?, max_interval=?, ignore_hints=? WHERE id=?`
+	_, err := db.ExecContext(ctx, query, s.MinInterval, s.MaxInterval, s.IgnoreHints, f.ID)
+	return err
+}
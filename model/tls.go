@@ -0,0 +1,66 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TLSScopeFeed = "feed"
+	TLSScopeHost = "host"
+)
+
+// TLSOptions customize certificate verification and client authentication
+// for one feed, or for every feed on a host. The client key is stored
+// encrypted and never returned.
+type TLSOptions struct {
+	CA        string     `json:"ca,omitempty"`
+	Cert      string     `json:"cert,omitempty"`
+	Key       []byte     `json:"-"`
+	HasKey    bool       `json:"has_key"`
+	Pins      []string   `json:"pins,omitempty"`
+	Insecure  bool       `json:"insecure_skip_verify"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// GetTLSOptions returns sql.ErrNoRows when nothing is configured.
+func GetTLSOptions(ctx context.Context, scope, target string, db *sql.Tx) (TLSOptions, error) {
+	const query = `SELECT ca, cert, key, pins, insecure, updated_at FROM tls_option WHERE scope=? AND target=?`
+	var (
+		o    TLSOptions
+		pins string
+	)
+
+	err := db.QueryRowContext(ctx, query, scope, target).Scan(&o.CA, &o.Cert, &o.Key, &pins, &o.Insecure, &o.UpdatedAt)
+	if err != nil {
+		return o, err
+	}
+
+	if pins != "" {
+		o.Pins = strings.Split(pins, "\n")
+	}
+	o.HasKey = len(o.Key) > 0
+
+	return o, nil
+}
+
+func SetTLSOptions(ctx context.Context, scope, target string, o TLSOptions, db *sql.Tx) error {
+	const query = `INSERT INTO tls_option (scope, target, ca, cert, key, pins, insecure, updated_at) VALUES(?,?,?,?,?,?,?,?)
+    ON CONFLICT (scope, target) DO UPDATE SET ca=excluded.ca, cert=excluded.cert, key=excluded.key, pins=excluded.pins, insecure=excluded.insecure, updated_at=excluded.updated_at`
+	_, err := db.ExecContext(ctx, query, scope, target, o.CA, o.Cert, o.Key, strings.Join(o.Pins, "\n"), o.Insecure, time.Now())
+	return err
+}
+
+func DeleteTLSOptions(ctx context.Context, scope, target string, db *sql.Tx) error {
+	const query = `DELETE FROM tls_option WHERE scope=? AND target=?`
+	_, err := db.ExecContext(ctx, query, scope, target)
+	return err
+}
+
+// TLSTarget is how a feed is named in the tls_option table.
+func (f Feed) TLSTarget() string {
+	return strconv.FormatInt(f.ID, 10)
+}
@@ -0,0 +1,82 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+const (
+	SubscriptionPending       = "pending"
+	SubscriptionActive        = "active"
+	SubscriptionFailed        = "failed"
+	SubscriptionDenied        = "denied"
+	SubscriptionUnsubscribing = "unsubscribing"
+)
+
+// Subscription is a WebSub subscription to a hub for one feed. Secret is
+// shared with the hub and used to sign content distributions, and is
+// stored sealed.
+type Subscription struct {
+	Feed         int64      `json:"feed"`
+	Hub          string     `json:"hub"`
+	Topic        string     `json:"topic"`
+	Secret       []byte     `json:"-"`
+	State        string     `json:"state"`
+	LeaseSeconds int64      `json:"lease_seconds"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	RenewAt      *time.Time `json:"renew_at"`
+	LastError    string     `json:"last_error,omitempty"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+const subscriptionColumns = `feed, hub, topic, secret, state, lease_seconds, expires_at, renew_at, last_error, updated_at`
+
+func scanSubscription(row scanner) (Subscription, error) {
+	var s Subscription
+	err := row.Scan(&s.Feed, &s.Hub, &s.Topic, &s.Secret, &s.State, &s.LeaseSeconds, &s.ExpiresAt, &s.RenewAt, &s.LastError, &s.UpdatedAt)
+	return s, err
+}
+
+func (f Feed) GetSubscription(ctx context.Context, db *sql.Tx) (Subscription, error) {
+	const query = `SELECT ` + subscriptionColumns + ` FROM websub_subscription WHERE feed=?`
+	return scanSubscription(db.QueryRowContext(ctx, query, f.ID))
+}
+
+func (f Feed) SetSubscription(ctx context.Context, s Subscription, db *sql.Tx) error {
+	const query = `INSERT INTO websub_subscription (` + subscriptionColumns + `) VALUES(?,?,?,?,?,?,?,?,?,?)
+    ON CONFLICT (feed) DO UPDATE SET hub=excluded.hub, topic=excluded.topic, secret=excluded.secret, state=excluded.state, lease_seconds=excluded.lease_seconds, expires_at=excluded.expires_at, renew_at=excluded.renew_at, last_error=excluded.last_error, updated_at=excluded.updated_at`
+	_, err := db.ExecContext(ctx, query, f.ID, s.Hub, s.Topic, s.Secret, s.State, s.LeaseSeconds, s.ExpiresAt, s.RenewAt, s.LastError, time.Now())
+	return err
+}
+
+func (f Feed) DeleteSubscription(ctx context.Context, db *sql.Tx) error {
+	const query = `DELETE FROM websub_subscription WHERE feed=?`
+	_, err := db.ExecContext(ctx, query, f.ID)
+	return err
+}
+
+// FindDueSubscriptions returns subscriptions that need to be renewed or
+// retried because their lease is running out or the hub never verified.
+func FindDueSubscriptions(ctx context.Context, now time.Time, db *sql.Tx) ([]Subscription, error) {
+	const query = `SELECT ` + subscriptionColumns + ` FROM websub_subscription
+    WHERE state IN (?,?,?) AND renew_at <= ? ORDER BY renew_at`
+
+	rows, err := db.QueryContext(ctx, query, SubscriptionPending, SubscriptionActive, SubscriptionFailed, now)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var subs []Subscription
+	for rows.Next() {
+		s, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, s)
+	}
+
+	return subs, rows.Err()
+}
@@ -0,0 +1,419 @@
+package backcast
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/leedo/backcast/model"
+)
+
+// elementPath is the XPath subset removal rules use: slash separated
+// element names from the root, or from anywhere after a leading //, with
+// * matching any element. Namespace prefixes are ignored.
+type elementPath struct {
+	anywhere bool
+	steps    []string
+}
+
+func parseElementPath(p string) (elementPath, error) {
+	var e elementPath
+
+	p = strings.TrimSpace(p)
+	switch {
+	case strings.HasPrefix(p, "//"):
+		e.anywhere, p = true, p[2:]
+	case strings.HasPrefix(p, "/"):
+		p = p[1:]
+	default:
+		e.anywhere = true
+	}
+
+	if strings.ContainsAny(p, "[]@()") {
+		return e, fmt.Errorf("path %q uses predicates or attributes, only element names are supported", p)
+	}
+
+	for _, step := range strings.Split(p, "/") {
+		if step == "" {
+			return e, fmt.Errorf("path %q has an empty step", p)
+		}
+		if i := strings.IndexByte(step, ':'); i >= 0 {
+			step = step[i+1:]
+		}
+		e.steps = append(e.steps, step)
+	}
+
+	return e, nil
+}
+
+func (e elementPath) match(stack []string) bool {
+	if len(stack) < len(e.steps) || !e.anywhere && len(stack) != len(e.steps) {
+		return false
+	}
+
+	stack = stack[len(stack)-len(e.steps):]
+	for i, step := range e.steps {
+		if step != "*" && step != stack[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// removeElements drops the elements matching path from body, and leaves a
+// body that does not parse as it is.
+func removeElements(body string, path elementPath) (string, error) {
+	var (
+		stack []string
+		cuts  []byteRange
+	)
+
+	dec := newXMLDecoder([]byte(body))
+
+	for {
+		offset := dec.InputOffset()
+
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return body, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name.Local)
+			if !path.match(stack) {
+				continue
+			}
+			if err := dec.Skip(); err != nil {
+				return body, err
+			}
+			stack = stack[:len(stack)-1]
+			cuts = append(cuts, byteRange{offset, dec.InputOffset()})
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+
+	if len(cuts) == 0 {
+		return body, nil
+	}
+
+	var (
+		out strings.Builder
+		pos int64
+	)
+
+	for _, c := range cuts {
+		out.WriteString(body[pos:c.start])
+		pos = c.end
+	}
+	out.WriteString(body[pos:])
+
+	return out.String(), nil
+}
+
+// urlPattern finds URLs in text and attribute values. It stops at ] so a
+// URL at the end of a CDATA section does not swallow the terminator.
+var urlPattern = regexp.MustCompile(`https?://[^\s"'<>\]]+`)
+
+func paramMatch(params []string, name string) bool {
+	for _, p := range params {
+		if p == name || strings.HasSuffix(p, "*") && strings.HasPrefix(name, p[:len(p)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripQuery drops the named query parameters from every URL in body. A
+// name ending in * matches any parameter starting with the rest.
+func stripQuery(body string, params []string) string {
+	return urlPattern.ReplaceAllStringFunc(body, func(u string) string {
+		i := strings.IndexByte(u, '?')
+		if i < 0 {
+			return u
+		}
+
+		query, fragment := u[i+1:], ""
+		if j := strings.IndexByte(query, '#'); j >= 0 {
+			query, fragment = query[:j], query[j:]
+		}
+
+		// in XML the separators are usually escaped
+		sep := "&"
+		if strings.Contains(query, "&amp;") {
+			sep = "&amp;"
+		}
+
+		var kept []string
+		for _, p := range strings.Split(query, sep) {
+			name := p
+			if k := strings.IndexByte(p, '='); k >= 0 {
+				name = p[:k]
+			}
+			if !paramMatch(params, name) {
+				kept = append(kept, p)
+			}
+		}
+
+		out := u[:i]
+		if len(kept) > 0 {
+			out += "?" + strings.Join(kept, sep)
+		}
+		return out + fragment
+	})
+}
+
+// compiledRule is a normalization rule parsed once per job, so patterns
+// and paths are not compiled again for every body.
+type compiledRule struct {
+	model.NormalizeRule
+	name string
+	path elementPath
+	re   *regexp.Regexp
+}
+
+func compileRule(r model.NormalizeRule) (compiledRule, error) {
+	c := compiledRule{NormalizeRule: r}
+
+	var err error
+	switch r.Kind {
+	case model.RuleRemove:
+		c.path, err = parseElementPath(r.Path)
+	case model.RuleReplace:
+		if r.Pattern == "" {
+			err = fmt.Errorf("replace rules need a pattern")
+		} else {
+			c.re, err = regexp.Compile(r.Pattern)
+		}
+	case model.RuleStripQuery:
+		if len(r.Params) == 0 {
+			err = fmt.Errorf("strip_query rules need at least one param")
+		}
+	default:
+		err = fmt.Errorf("unknown rule kind %q", r.Kind)
+	}
+
+	return c, err
+}
+
+func validateRules(rules []model.NormalizeRule) error {
+	for n, r := range rules {
+		if _, err := compileRule(r); err != nil {
+			return fmt.Errorf("rule %d: %v", n, err)
+		}
+	}
+	return nil
+}
+
+// ruleList is one scope's rules, compiled. Stored rules were validated
+// when they were set, but a rule that no longer compiles is left out and
+// listed in skipped rather than failing the fetch.
+type ruleList struct {
+	rules   []compiledRule
+	skipped []string
+}
+
+func compileRules(scope string, rules []model.NormalizeRule) ruleList {
+	var l ruleList
+	for n, r := range rules {
+		c, err := compileRule(r)
+		c.name = fmt.Sprintf("%s rule %d", scope, n)
+		if err != nil {
+			l.skipped = append(l.skipped, fmt.Sprintf("%s: %v", c.name, err))
+			continue
+		}
+		l.rules = append(l.rules, c)
+	}
+	return l
+}
+
+// ruleSet is the global rules followed by the feed's own.
+type ruleSet struct {
+	global ruleList
+	feed   ruleList
+}
+
+// apply normalizes body with each rule in turn. A rule that cannot be
+// applied is skipped and reported, so normalizing never keeps a feed from
+// archiving.
+func (s ruleSet) apply(body string) (string, []string) {
+	skipped := append(append([]string(nil), s.global.skipped...), s.feed.skipped...)
+
+	for _, l := range []ruleList{s.global, s.feed} {
+		for _, r := range l.rules {
+			switch r.Kind {
+			case model.RuleRemove:
+				out, err := removeElements(body, r.path)
+				if err != nil {
+					skipped = append(skipped, fmt.Sprintf("%s: %v", r.name, err))
+					continue
+				}
+				body = out
+			case model.RuleReplace:
+				body = r.re.ReplaceAllString(body, r.Replacement)
+			case model.RuleStripQuery:
+				body = stripQuery(body, r.Params)
+			}
+		}
+	}
+
+	return body, skipped
+}
+
+func (a *App) getRules(w http.ResponseWriter, r *http.Request, feed int64) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	defer tx.Rollback()
+
+	rules, err := model.GetNormalizeRules(r.Context(), feed, tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(rules); err != nil {
+		jsonError(err, w)
+		return
+	}
+}
+
+func (a *App) setRules(w http.ResponseWriter, r *http.Request, feed int64) {
+	var rules []model.NormalizeRule
+
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&rules); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if err := validateRules(rules); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	defer tx.Rollback()
+
+	if err := model.SetNormalizeRules(r.Context(), feed, rules, tx); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(rules); err != nil {
+		jsonError(err, w)
+		return
+	}
+}
+
+func (a *App) deleteRules(w http.ResponseWriter, r *http.Request, feed int64) {
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	defer tx.Rollback()
+
+	if err := model.DeleteNormalizeRules(r.Context(), feed, tx); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	fmt.Fprint(w, `{"status":"ok"}`)
+}
+
+// rulesFeed resolves the feed in the route, so rules are never stored for
+// a feed that does not exist.
+func (a *App) rulesFeed(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (int64, bool) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		jsonInternalError(err, w)
+		return 0, false
+	}
+
+	defer tx.Rollback()
+
+	feed, err := model.GetFeed(r.Context(), ps.ByName("id"), tx)
+	if err != nil {
+		jsonError(err, w)
+		return 0, false
+	}
+
+	return feed.ID, true
+}
+
+func (a *App) feedRulesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if id, ok := a.rulesFeed(w, r, ps); ok {
+		a.getRules(w, r, id)
+	}
+}
+
+func (a *App) updateFeedRulesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if id, ok := a.rulesFeed(w, r, ps); ok {
+		a.setRules(w, r, id)
+	}
+}
+
+func (a *App) deleteFeedRulesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if id, ok := a.rulesFeed(w, r, ps); ok {
+		a.deleteRules(w, r, id)
+	}
+}
+
+func (a *App) globalRulesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	a.getRules(w, r, model.GlobalRules)
+}
+
+func (a *App) updateGlobalRulesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	a.setRules(w, r, model.GlobalRules)
+}
+
+func (a *App) deleteGlobalRulesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	a.deleteRules(w, r, model.GlobalRules)
+}
+
+// rawRequested reports whether the client asked for a revision as it was
+// fetched, before normalization rules.
+func rawRequested(r *http.Request) bool {
+	raw, _ := strconv.ParseBool(r.URL.Query().Get("raw"))
+	return raw
+}
@@ -0,0 +1,84 @@
+package backcast
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/leedo/backcast/model"
+)
+
+func TestRuleSet(t *testing.T) {
+	rules := ruleSet{
+		global: compileRules("global", []model.NormalizeRule{
+			{Kind: model.RuleReplace, Pattern: `<lastBuildDate>[^<]*</lastBuildDate>`},
+			{Kind: model.RuleReplace, Pattern: `(`},
+		}),
+		feed: compileRules("feed", []model.NormalizeRule{
+			{Kind: model.RuleRemove, Path: "//item/comments"},
+			{Kind: model.RuleStripQuery, Params: []string{"utm_*"}},
+		}),
+	}
+
+	const body = `<rss><channel><lastBuildDate>now</lastBuildDate>
+<item><link>http://example.com/1?utm_source=x&amp;id=1</link><comments>3</comments></item></channel></rss>`
+
+	got, skipped := rules.apply(body)
+
+	const want = `<rss><channel>
+<item><link>http://example.com/1?id=1</link></item></channel></rss>`
+	if got != want {
+		t.Errorf("normalized to\n%s\nwant\n%s", got, want)
+	}
+
+	if len(skipped) != 1 || !strings.HasPrefix(skipped[0], "global rule 1: ") {
+		t.Errorf("skipped %q, want the global rule that does not compile", skipped)
+	}
+
+	// a body that does not parse keeps the remove rule from applying
+	if _, skipped := rules.apply("not a feed <"); len(skipped) != 2 || !strings.HasPrefix(skipped[1], "feed rule 0: ") {
+		t.Errorf("skipped %q on a body that does not parse, want the remove rule too", skipped)
+	}
+}
+
+// TestPreviewReportsSkippedRules stores a rule that no longer compiles and
+// checks the preview says so instead of skipping it silently.
+func TestPreviewReportsSkippedRules(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testFeed))
+	}))
+	defer srv.Close()
+
+	a := newTestApp(t, Config{})
+	f := addTestFeed(t, a, srv.URL+"/feed.xml")
+	ctx := context.Background()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := []model.NormalizeRule{{Kind: model.RuleReplace, Pattern: `[`}}
+	if err := model.SetNormalizeRules(ctx, f.ID, bad, tx); err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+
+	rec := httptest.NewRecorder()
+	a.routes().ServeHTTP(rec, httptest.NewRequest("POST", "/api/feed/"+strconv.FormatInt(f.ID, 10)+"/preview", nil))
+
+	var p preview
+	if err := json.NewDecoder(rec.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.Code != http.StatusOK || len(p.SkippedRules) != 1 || !strings.HasPrefix(p.SkippedRules[0], "feed rule 0: ") {
+		t.Errorf("preview answered %d skipping %q, want the feed rule reported", rec.Code, p.SkippedRules)
+	}
+	if !p.Changed {
+		t.Error("preview with a skipped rule did not go on to diff the feed")
+	}
+}
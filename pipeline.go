@@ -0,0 +1,379 @@
+package backcast
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/leedo/backcast/model"
+)
+
+// fetchJob carries one feed through the refresh pipeline. The load and
+// commit stages are the only ones that use the database, each with one
+// short transaction, and nothing holds a transaction across network I/O.
+type fetchJob struct {
+	feed     model.Feed
+	settings feedSettings
+	source   Source
+	request  SourceRequest
+
+	// base is the revision current when the job was loaded, the change
+	// is diffed against it and only committed if it is still current
+	base       string
+	baseSum    string
+	baseRawSum string
+	current    string
+	body       string
+	resp       *FetchResponse
+	revision   model.Revision
+	change     model.Change
+	tags       podcastTags
+
+	// parseErr is set when a 200 body is not a feed. The body is still
+	// archived, but the check counts as a failure.
+	parseErr error
+
+	// rules normalize the body before it is diffed, skippedRules are the
+	// ones that could not be compiled or applied
+	rules        ruleSet
+	skippedRules []string
+}
+
+func (a *App) updateFeed(ctx context.Context, f model.Feed) (*FetchResponse, bool, error) {
+	job, err := a.loadJob(ctx, f)
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = a.fetchBody(ctx, job)
+
+	// a consent page sets its cookie even when the fetch goes on to fail
+	if err := a.saveCookies(ctx, job.settings.Cookies); err != nil {
+		log.Printf("could not save cookies for feed %d (%s): %v", f.ID, f.URL, err)
+	}
+
+	if err != nil {
+		return job.resp, false, err
+	}
+
+	if err := a.normalizeBody(ctx, job); err != nil {
+		return job.resp, false, err
+	}
+
+	if err := a.confirmMove(ctx, job); err != nil {
+		return job.resp, false, err
+	}
+
+	ok, err := a.commitJob(ctx, job)
+	if err == model.ErrConcurrentCommit {
+		// whoever committed first has content at least as new as ours
+		log.Printf("not committing feed %d (%s), it was updated during the fetch", f.ID, f.URL)
+		return job.resp, false, nil
+	}
+
+	if err == nil && job.parseErr != nil {
+		return job.resp, ok, job.parseErr
+	}
+
+	return job.resp, ok, err
+}
+
+// commitPushed stores content pushed by a hub. Nothing is newer than a
+// push, so losing a race to another commit only means diffing again.
+func (a *App) commitPushed(ctx context.Context, f model.Feed, resp *FetchResponse) (bool, error) {
+	for i := 0; i < 3; i++ {
+		job, err := a.loadJob(ctx, f)
+		if err != nil {
+			return false, err
+		}
+
+		job.resp = resp
+		if err := a.normalizeBody(ctx, job); err != nil {
+			return false, err
+		}
+
+		if err := a.confirmMove(ctx, job); err != nil {
+			return false, err
+		}
+
+		ok, err := a.commitJob(ctx, job)
+		if err != model.ErrConcurrentCommit {
+			return ok, err
+		}
+	}
+
+	return false, model.ErrConcurrentCommit
+}
+
+// loadJob reads what the fetch needs: settings, the source and the
+// validators of the current revision.
+func (a *App) loadJob(ctx context.Context, f model.Feed) (*fetchJob, error) {
+	src, u, err := a.source(f.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	settings, err := a.loadFeedSettings(ctx, f, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &fetchJob{
+		feed:     f,
+		settings: settings,
+		source:   src,
+		request: SourceRequest{
+			Feed:        f,
+			URL:         u,
+			Options:     settings.Options,
+			credentials: settings.Credentials,
+			tls:         settings.TLS,
+			cookies:     settings.Cookies,
+		},
+	}
+
+	if job.base, err = f.HeadRevision(ctx, tx); err != nil {
+		return nil, err
+	}
+
+	global, err := model.GetNormalizeRules(ctx, model.GlobalRules, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := model.GetNormalizeRules(ctx, f.ID, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	job.rules = ruleSet{global: compileRules("global", global), feed: compileRules("feed", rules)}
+
+	// the base is read from the database rather than taken from f, which
+	// may be stale when a commit is retried
+	if job.base == "" {
+		return job, nil
+	}
+
+	r, err := f.GetRevision(ctx, job.base, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	job.baseSum = r.Checksum
+	job.baseRawSum = firstNonEmpty(r.RawChecksum, r.Checksum)
+	job.request.Etag = r.Etag
+	job.request.LastModified = r.LastModified
+
+	return job, nil
+}
+
+func (a *App) fetchBody(ctx context.Context, job *fetchJob) error {
+	f := job.feed
+
+	if a.config.RespectRobots && !job.settings.Options.IgnoreRobots {
+		allowed, delay, err := a.robots.check(ctx, f.URL, job.settings.TLS)
+		if err != nil {
+			return err
+		}
+		a.limiter.setCrawlDelay(feedHost(f.URL), delay)
+		if !allowed {
+			return errRobotsDisallowed
+		}
+	}
+
+	resp, err := job.source.Fetch(ctx, job.request)
+	if err != nil {
+		return err
+	}
+
+	job.resp = resp
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNotModified:
+		return nil
+	default:
+		return fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+}
+
+// normalizeBody turns a fetched body into a change against the base
+// revision, reading the base text in its own read-only transaction.
+func (a *App) normalizeBody(ctx context.Context, job *fetchJob) error {
+	resp := job.resp
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	job.revision = model.Revision{
+		ContentType:  resp.Header.Get("Content-Type"),
+		Etag:         resp.Header.Get("Etag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Charset:      detectCharset(resp.Header.Get("Content-Type"), resp.Body),
+	}
+
+	body := string(resp.Body)
+	if a.config.Transcode {
+		if text, charset := transcode(job.revision.ContentType, resp.Body); charset != "" {
+			body = text
+			job.revision.Transcoded = true
+		}
+	}
+
+	raw := body
+	body, job.skippedRules = job.rules.apply(body)
+	if len(job.skippedRules) > 0 {
+		log.Printf("skipped normalization rules for feed %d (%s): %s", job.feed.ID, job.feed.URL, strings.Join(job.skippedRules, "; "))
+	}
+
+	var current string
+	if job.baseSum != "" {
+		tx, err := a.db.Begin()
+		if err != nil {
+			return err
+		}
+
+		current, err = job.feed.BuildFeed(ctx, job.baseSum, tx)
+		tx.Rollback()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	job.current, job.body = current, body
+	if _, err := parseFeed([]byte(body)); err != nil && body != "" {
+		job.parseErr = parseError{err}
+	}
+	job.change = model.PrepareChange(job.base, current, body)
+	job.change.SetRaw(body, raw)
+
+	// a fetch that differs only in what the rules removed is counted
+	// against the head instead of archived
+	if job.change.Patch == "" && job.baseRawSum != "" {
+		job.change.Suppressed = fmt.Sprintf("%x", sha1.Sum([]byte(raw))) != job.baseRawSum
+	}
+	job.tags = parsePodcastTags(resp.Body)
+
+	return nil
+}
+
+// confirmMove decides whether to follow an itunes:new-feed-url. Only a
+// change that announces a new target is considered, and a target that
+// was refused before or does not serve a feed is dropped, so a move that
+// cannot happen costs one check instead of one fetch per poll.
+func (a *App) confirmMove(ctx context.Context, job *fetchJob) error {
+	f, target := job.feed, job.tags.NewFeedURL
+	if target == "" || target == f.URL {
+		return nil
+	}
+
+	job.tags.NewFeedURL = ""
+
+	if job.change.Patch == "" || parsePodcastTags([]byte(job.current)).NewFeedURL == target {
+		return nil
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	refused, err := f.MoveRefused(ctx, target, tx)
+	tx.Rollback()
+
+	if err != nil {
+		return err
+	} else if refused {
+		log.Printf("not moving feed %d (%s) to new-feed-url %s, refused before", f.ID, f.URL, target)
+		return nil
+	}
+
+	if a.config.ConfirmFeedMoves {
+		if err := a.confirmFeedURL(ctx, target, feedSettings{Options: job.settings.Options}); err != nil {
+			log.Printf("not moving feed %d (%s) to new-feed-url %s: %v", f.ID, f.URL, target, err)
+			return nil
+		}
+	}
+
+	job.tags.NewFeedURL = target
+	return nil
+}
+
+// commitJob stores the prepared change and follows any move the
+// response announced.
+func (a *App) commitJob(ctx context.Context, job *fetchJob) (bool, error) {
+	f, resp, tags := job.feed, job.resp, job.tags
+
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		return false, err
+	}
+
+	ok := false
+	if resp.StatusCode == http.StatusOK {
+		ok, err = f.CommitChange(ctx, job.change, job.revision, tx)
+		if err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+
+	indexed := true
+	if ok {
+		if indexed, err = a.indexCommit(ctx, f, job.base, job.body, tx); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+
+	if err := f.MarkChecked(ctx, resp.StatusCode, tx); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	if resp.PermanentURL != "" && resp.PermanentURL != f.URL {
+		reason := fmt.Sprintf("permanent redirect (%d)", resp.PermanentStatus)
+		if err := a.moveFeed(ctx, f, resp.PermanentURL, reason, tx); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+		f.URL = resp.PermanentURL
+	}
+
+	if tags.NewFeedURL != "" && tags.NewFeedURL != f.URL {
+		if err := a.moveFeed(ctx, f, tags.NewFeedURL, "itunes:new-feed-url", tx); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+
+	if tags.GUID != "" && tags.GUID != f.PodcastGUID {
+		if err := a.recordPodcastGUID(ctx, f, tags.GUID, tx); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	if !indexed {
+		a.requestBackfill()
+	}
+
+	return ok, nil
+}
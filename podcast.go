@@ -0,0 +1,118 @@
+package backcast
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/leedo/backcast/model"
+)
+
+const (
+	itunesNS  = "http://www.itunes.com/dtds/podcast-1.0.dtd"
+	podcastNS = "https://podcastindex.org/namespace/1.0"
+)
+
+type podcastTags struct {
+	NewFeedURL string
+	GUID       string
+}
+
+func parsePodcastTags(body []byte) podcastTags {
+	var (
+		tags  podcastTags
+		stack []xml.Name
+	)
+
+	dec := newXMLDecoder(body)
+
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			if len(stack) < 2 || stack[len(stack)-2].Local != "channel" {
+				continue
+			}
+			name := stack[len(stack)-1]
+			text := strings.TrimSpace(string(t))
+
+			switch {
+			case name.Local == "new-feed-url" && (name.Space == itunesNS || name.Space == "itunes"):
+				tags.NewFeedURL = text
+			case name.Local == "guid" && (name.Space == podcastNS || name.Space == "podcast"):
+				tags.GUID = text
+			}
+		}
+	}
+
+	if u, err := url.Parse(tags.NewFeedURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		tags.NewFeedURL = ""
+	}
+
+	return tags
+}
+
+// confirmFeedURL checks that a feed announced with itunes:new-feed-url
+// actually serves a feed before we migrate to it.
+func (a *App) confirmFeedURL(ctx context.Context, rawurl string, s feedSettings) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawurl, nil)
+	if err != nil {
+		return err
+	}
+
+	host := feedHost(rawurl)
+	if err := a.limiter.acquire(ctx, host); err != nil {
+		return err
+	}
+	defer a.limiter.release(host)
+
+	resp, err := a.fetcher.fetch(ctx, req, s)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+
+	switch rootElement(resp.Body) {
+	case "rss", "feed", "RDF":
+		return nil
+	default:
+		return fmt.Errorf("response is not a feed")
+	}
+}
+
+func (a *App) recordPodcastGUID(ctx context.Context, f model.Feed, guid string, tx *sql.Tx) error {
+	if err := f.SetPodcastGUID(ctx, guid, tx); err != nil {
+		return err
+	}
+
+	feeds, err := model.FindFeedsByGUID(ctx, guid, tx)
+	if err != nil {
+		return err
+	}
+
+	for _, other := range feeds {
+		if other.ID != f.ID {
+			log.Printf("feed %d (%s) has the same podcast:guid as feed %d (%s)", f.ID, f.URL, other.ID, other.URL)
+		}
+	}
+
+	return nil
+}
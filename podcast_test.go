@@ -0,0 +1,71 @@
+package backcast
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestRefusedMoveIsNotConfirmedAgain(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		item     = 1
+		confirms int
+	)
+
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	mux.HandleFunc("/a", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(w, `<rss version="2.0" xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd"><channel>
+<itunes:new-feed-url>%s/b</itunes:new-feed-url>
+<item><guid>%d</guid></item>
+</channel></rss>`, srv.URL, item)
+	})
+	mux.HandleFunc("/b", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		confirms++
+		mu.Unlock()
+		fmt.Fprint(w, `<rss version="2.0"><channel><title>B</title></channel></rss>`)
+	})
+
+	a := newTestApp(t, Config{ConfirmFeedMoves: true})
+	f := addTestFeed(t, a, srv.URL+"/a")
+	addTestFeed(t, a, srv.URL+"/b")
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		// every fetch is a new revision with the same new-feed-url
+		if _, ok, err := a.updateFeed(ctx, reloadFeed(t, a, f)); err != nil || !ok {
+			t.Fatalf("fetch %d: changed=%v err=%v", i+1, ok, err)
+		}
+		mu.Lock()
+		item++
+		mu.Unlock()
+	}
+
+	if confirms != 1 {
+		t.Errorf("new-feed-url was confirmed %d times, want once", confirms)
+	}
+
+	f = reloadFeed(t, a, f)
+	if f.URL != srv.URL+"/a" {
+		t.Errorf("feed moved to %s, which is already tracked", f.URL)
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	if refused, err := f.MoveRefused(ctx, srv.URL+"/b", tx); err != nil || !refused {
+		t.Errorf("move to tracked feed not remembered as refused: %v %v", refused, err)
+	}
+}
@@ -0,0 +1,188 @@
+package backcast
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/leedo/backcast/model"
+)
+
+// previewRequest optionally overrides a feed's settings for one preview,
+// to see what a change to them would do before saving it.
+type previewRequest struct {
+	Options     *model.FetchOptions `json:"options"`
+	Credentials *credentials        `json:"credentials"`
+
+	// Rules replace the feed's own normalization rules, the global
+	// rules still apply
+	Rules *[]model.NormalizeRule `json:"rules"`
+}
+
+type preview struct {
+	Status       int          `json:"status"`
+	BaseRevision string       `json:"base_revision"`
+	Changed      bool         `json:"changed"`
+	Patch        string       `json:"patch"`
+	BytesAdded   int          `json:"bytes_added"`
+	BytesRemoved int          `json:"bytes_removed"`
+	OldLength    int          `json:"old_length"`
+	NewLength    int          `json:"new_length"`
+	Charset      string       `json:"charset,omitempty"`
+	Transcoded   bool         `json:"transcoded"`
+	Normalized   bool         `json:"normalized"`
+	Suppressed   bool         `json:"suppressed"`
+	Items        *itemChanges `json:"items,omitempty"`
+	ParseError   string       `json:"parse_error,omitempty"`
+	SkippedRules []string     `json:"skipped_rules,omitempty"`
+
+	// BaseParseError is set when the archived revision does not parse, so
+	// its items could not be compared with the fetched ones
+	BaseParseError string `json:"base_parse_error,omitempty"`
+}
+
+// previewFeedHandler runs a fetch through the pipeline up to the commit,
+// and reports the change it would have made. Like the change, cookies
+// set by the server during a preview are not saved.
+func (a *App) previewFeedHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+
+	var pr previewRequest
+
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&pr); err != nil && err != io.EOF {
+		jsonError(err, w)
+		return
+	}
+
+	if pr.Credentials != nil {
+		if err := pr.Credentials.validate(); err != nil {
+			jsonError(err, w)
+			return
+		}
+	}
+
+	if pr.Rules != nil {
+		if err := validateRules(*pr.Rules); err != nil {
+			jsonError(err, w)
+			return
+		}
+	}
+
+	feed, jar, ok := a.previewFeed(w, r, ps, pr)
+	if !ok {
+		return
+	}
+
+	job, err := a.loadJob(ctx, feed)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if pr.Options != nil {
+		job.settings.Options = *pr.Options
+		job.request.Options = *pr.Options
+		job.settings.Cookies = jar
+		job.request.cookies = jar
+	}
+	if pr.Credentials != nil {
+		job.settings.Credentials = pr.Credentials
+		job.request.credentials = pr.Credentials
+	}
+	if pr.Rules != nil {
+		job.rules.feed = compileRules("feed", *pr.Rules)
+	}
+
+	// a conditional request could only say nothing changed
+	job.request.Etag, job.request.LastModified = "", ""
+
+	host := feedHost(feed.URL)
+	if err := a.limiter.acquire(ctx, host); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	err = a.fetchBody(ctx, job)
+	a.limiter.release(host)
+
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if err := a.normalizeBody(ctx, job); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	p := preview{
+		Status:       job.resp.StatusCode,
+		BaseRevision: job.base,
+		Changed:      job.change.Patch != "",
+		Patch:        job.change.Patch,
+		BytesAdded:   job.change.Inserted,
+		BytesRemoved: job.change.Deleted,
+		OldLength:    len(job.current),
+		NewLength:    len(job.body),
+		Charset:      job.revision.Charset,
+		Transcoded:   job.revision.Transcoded,
+		Normalized:   job.change.RawChecksum != "",
+		Suppressed:   job.change.Suppressed,
+		SkippedRules: job.skippedRules,
+	}
+
+	if p.Changed {
+		after, err := parseFeed([]byte(job.body))
+		before, baseErr := parseFeed([]byte(job.current))
+
+		switch {
+		case err != nil:
+			p.ParseError = err.Error()
+		case job.current != "" && baseErr != nil:
+			// every item would look new, which says nothing about the fetch
+			p.BaseParseError = baseErr.Error()
+		default:
+			// with nothing archived yet every item is new
+			changes := diffItems(before.Items, after.Items)
+			p.Items = &changes
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(p); err != nil {
+		jsonError(err, w)
+		return
+	}
+}
+
+// previewFeed reads the feed in the route and, when the preview overrides
+// the options with cookies enabled, its cookie jar, in one transaction.
+func (a *App) previewFeed(w http.ResponseWriter, r *http.Request, ps httprouter.Params, pr previewRequest) (model.Feed, *cookieJar, bool) {
+	ctx := r.Context()
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		jsonInternalError(err, w)
+		return model.Feed{}, nil, false
+	}
+
+	defer tx.Rollback()
+
+	feed, err := model.GetFeed(ctx, ps.ByName("id"), tx)
+	if err != nil {
+		jsonError(err, w)
+		return feed, nil, false
+	}
+
+	var jar *cookieJar
+	if pr.Options != nil && pr.Options.Cookies {
+		if jar, err = loadCookieJar(ctx, feedHost(feed.URL), tx); err != nil {
+			jsonInternalError(err, w)
+			return feed, nil, false
+		}
+	}
+
+	return feed, jar, true
+}
@@ -0,0 +1,46 @@
+package backcast
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// TestPreviewFlagsUnparsableBase archives a body that is not a feed and
+// checks a preview says so instead of reporting every item as new.
+func TestPreviewFlagsUnparsableBase(t *testing.T) {
+	body := "<html><body>parked</body></html>"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	a := newTestApp(t, Config{})
+	f := addTestFeed(t, a, srv.URL+"/feed.xml")
+
+	// a body that is not a feed is archived but fails the check
+	a.updateFeed(context.Background(), f)
+	if f = reloadFeed(t, a, f); f.CurrentRevision == "" {
+		t.Fatal("nothing archived")
+	}
+
+	body = testFeed
+
+	rec := httptest.NewRecorder()
+	a.routes().ServeHTTP(rec, httptest.NewRequest("POST", "/api/feed/"+strconv.FormatInt(f.ID, 10)+"/preview", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("preview answered %d: %s", rec.Code, rec.Body)
+	}
+
+	var p preview
+	if err := json.NewDecoder(rec.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+
+	if !p.Changed || p.BaseParseError == "" || p.Items != nil {
+		t.Errorf("preview on an unparsable base changed %v with base error %q and items %+v, want the error and no items", p.Changed, p.BaseParseError, p.Items)
+	}
+}
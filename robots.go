@@ -0,0 +1,271 @@
+package backcast
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leedo/backcast/model"
+)
+
+const (
+	robotsTTL     = 24 * time.Hour
+	robotsMaxSize = 512 << 10
+)
+
+var errRobotsDisallowed = errors.New("disallowed by robots.txt")
+
+type robotsRule struct {
+	allow   bool
+	length  int
+	pattern *regexp.Regexp
+}
+
+type robotsGroup struct {
+	agents     []string
+	rules      []robotsRule
+	crawlDelay time.Duration
+}
+
+type robotsRules struct {
+	groups []*robotsGroup
+}
+
+func parseRobots(body []byte) *robotsRules {
+	var (
+		rules   = &robotsRules{}
+		current *robotsGroup
+		inRules bool
+	)
+
+	s := bufio.NewScanner(bytes.NewReader(body))
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+
+		switch key {
+		case "user-agent":
+			// consecutive user-agent lines share one group
+			if current == nil || inRules {
+				current = &robotsGroup{}
+				rules.groups = append(rules.groups, current)
+				inRules = false
+			}
+			current.agents = append(current.agents, strings.ToLower(value))
+		case "allow", "disallow":
+			if current == nil {
+				continue
+			}
+			inRules = true
+			if value == "" {
+				continue
+			}
+			current.rules = append(current.rules, robotsRule{key == "allow", len(value), robotsPattern(value)})
+		case "crawl-delay":
+			if current == nil {
+				continue
+			}
+			inRules = true
+			if n, err := strconv.ParseFloat(value, 64); err == nil && n > 0 {
+				current.crawlDelay = time.Duration(n * float64(time.Second))
+			}
+		}
+	}
+
+	return rules
+}
+
+// group picks the group with the longest user-agent matching our product
+// token, falling back to the * group.
+func (r *robotsRules) group(agent string) *robotsGroup {
+	var (
+		best    *robotsGroup
+		bestLen int
+	)
+
+	for _, g := range r.groups {
+		for _, a := range g.agents {
+			switch {
+			case a == "*" && best == nil:
+				best = g
+			case a != "*" && strings.Contains(agent, a) && len(a) > bestLen:
+				best = g
+				bestLen = len(a)
+			}
+		}
+	}
+
+	return best
+}
+
+func (r *robotsRules) allowed(agent string, path string) (bool, time.Duration) {
+	g := r.group(agent)
+	if g == nil {
+		return true, 0
+	}
+
+	var (
+		allow   = true
+		longest = -1
+	)
+
+	for _, rule := range g.rules {
+		if !rule.pattern.MatchString(path) {
+			continue
+		}
+		if rule.length > longest || (rule.length == longest && rule.allow) {
+			longest = rule.length
+			allow = rule.allow
+		}
+	}
+
+	return allow, g.crawlDelay
+}
+
+// robotsPattern compiles a robots.txt path pattern, where * matches any
+// sequence of characters and a trailing $ anchors the end of the path.
+func robotsPattern(pattern string) *regexp.Regexp {
+	anchored := strings.HasSuffix(pattern, "$")
+	if anchored {
+		pattern = pattern[:len(pattern)-1]
+	}
+
+	expr := "^" + strings.Replace(regexp.QuoteMeta(pattern), `\*`, ".*", -1)
+	if anchored {
+		expr += "$"
+	}
+
+	return regexp.MustCompile(expr)
+}
+
+type robotsEntry struct {
+	rules   *robotsRules
+	expires time.Time
+}
+
+type robotsCache struct {
+	mu      sync.Mutex
+	fetcher *fetcher
+	limiter *hostLimiter
+	agent   string
+	entries map[string]robotsEntry
+}
+
+func newRobotsCache(c Config, f *fetcher, l *hostLimiter) *robotsCache {
+	agent := strings.ToLower(c.UserAgent)
+	if i := strings.IndexAny(agent, "/ "); i > 0 {
+		agent = agent[:i]
+	}
+
+	return &robotsCache{
+		fetcher: f,
+		limiter: l,
+		agent:   agent,
+		entries: make(map[string]robotsEntry),
+	}
+}
+
+func (rc *robotsCache) rules(ctx context.Context, u *url.URL, ts *tlsSettings) (*robotsRules, error) {
+	key := u.Scheme + "://" + u.Host
+
+	rc.mu.Lock()
+	e, ok := rc.entries[key]
+	rc.mu.Unlock()
+
+	if ok && time.Now().Before(e.expires) {
+		return e.rules, nil
+	}
+
+	e, err := rc.fetch(ctx, key, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	rc.mu.Lock()
+	rc.entries[key] = e
+	rc.mu.Unlock()
+
+	return e.rules, nil
+}
+
+// fetch treats a missing robots.txt as allowing everything. A server
+// error or unreachable host is not cached and fails the check like any
+// other fetch failure, since it says nothing about what is allowed. The
+// request takes a token from the host limiter, under the connection slot
+// the feed's own fetch holds.
+func (rc *robotsCache) fetch(ctx context.Context, base string, ts *tlsSettings) (robotsEntry, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", base+"/robots.txt", nil)
+	if err != nil {
+		return robotsEntry{}, err
+	}
+
+	if err := rc.limiter.wait(ctx, feedHost(base)); err != nil {
+		return robotsEntry{}, err
+	}
+
+	now := time.Now()
+
+	resp, err := rc.fetcher.fetch(ctx, req, feedSettings{Options: model.FetchOptions{MaxBodySize: robotsMaxSize}, TLS: ts})
+	if err != nil {
+		var body bodyError
+		if errors.As(err, &body) {
+			return robotsEntry{&robotsRules{}, now.Add(robotsTTL)}, nil
+		}
+		return robotsEntry{}, fmt.Errorf("fetching robots.txt: %w", err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return robotsEntry{parseRobots(resp.Body), now.Add(robotsTTL)}, nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return robotsEntry{&robotsRules{}, now.Add(robotsTTL)}, nil
+	default:
+		return robotsEntry{}, fmt.Errorf("fetching robots.txt: unexpected response status %s", resp.Status)
+	}
+}
+
+func (rc *robotsCache) check(ctx context.Context, rawurl string, ts *tlsSettings) (bool, time.Duration, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return false, 0, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return true, 0, nil
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+
+	rules, err := rc.rules(ctx, u, ts)
+	if err != nil {
+		return false, 0, err
+	}
+
+	allowed, delay := rules.allowed(rc.agent, path)
+	return allowed, delay, nil
+}
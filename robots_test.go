@@ -0,0 +1,58 @@
+package backcast
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/leedo/backcast/model"
+)
+
+func TestRobots(t *testing.T) {
+	robots := http.StatusServiceUnavailable
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		if robots != http.StatusOK {
+			w.WriteHeader(robots)
+			return
+		}
+		w.Write([]byte("User-agent: *\nDisallow: /private\n"))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testFeed))
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	a := newTestApp(t, Config{RespectRobots: true, HostRate: 0.001, HostBurst: 5})
+	f := addTestFeed(t, a, srv.URL+"/private/feed.xml")
+	ctx := context.Background()
+
+	// an unavailable robots.txt is an ordinary failure, not a rule
+	if _, err := a.checkFeed(ctx, reloadFeed(t, a, f)); err == nil {
+		t.Fatal("check succeeded while robots.txt was unavailable")
+	}
+
+	f = reloadFeed(t, a, f)
+	if f.Status == model.StatusDisallowed || f.FailureCount != 1 {
+		t.Errorf("status %q with %d failures, want a counted failure", f.Status, f.FailureCount)
+	}
+
+	for _, h := range a.limiter.status() {
+		if h.Tokens > 4.5 {
+			t.Errorf("robots.txt fetch left %.2f of 5 tokens for %s, want one taken", h.Tokens, h.Host)
+		}
+	}
+
+	robots = http.StatusOK
+	if _, err := a.checkFeed(ctx, f); err == nil {
+		t.Fatal("check of a disallowed feed succeeded")
+	}
+
+	if f = reloadFeed(t, a, f); f.Status != model.StatusDisallowed {
+		t.Errorf("status %q, want %q", f.Status, model.StatusDisallowed)
+	}
+}
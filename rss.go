@@ -0,0 +1,180 @@
+package backcast
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/leedo/backcast/model"
+)
+
+// rssDocument is a plain RSS 2.0 feed, for the feeds backcast builds from
+// parsed items rather than archives.
+type rssDocument struct {
+	XMLName   xml.Name   `xml:"rss"`
+	Version   string     `xml:"version,attr"`
+	DC        string     `xml:"xmlns:dc,attr"`
+	ContentNS string     `xml:"xmlns:content,attr"`
+	Channel   rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	Language      string    `xml:"language,omitempty"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int64  `xml:"length,attr"`
+}
+
+type rssItem struct {
+	// set when the item goes into a document that may not declare them
+	DC        string `xml:"xmlns:dc,attr,omitempty"`
+	ContentNS string `xml:"xmlns:content,attr,omitempty"`
+
+	Title       string        `xml:"title,omitempty"`
+	Link        string        `xml:"link,omitempty"`
+	Description string        `xml:"description,omitempty"`
+	Content     string        `xml:"content:encoded,omitempty"`
+	Author      string        `xml:"dc:creator,omitempty"`
+	Categories  []string      `xml:"category"`
+	GUID        rssGUID       `xml:"guid"`
+	PubDate     string        `xml:"pubDate,omitempty"`
+	Enclosure   *rssEnclosure `xml:"enclosure"`
+}
+
+func newRSSItem(i model.Item) rssItem {
+	r := rssItem{
+		Title:       i.Title,
+		Link:        i.Link,
+		Description: i.Description,
+		Content:     i.Content,
+		Author:      i.Author,
+		Categories:  i.Categories,
+		GUID:        rssGUID{Value: i.Key},
+		PubDate:     i.PubDate,
+	}
+
+	// dates are written the way RSS asks for when we could read them
+	if i.Published != nil {
+		r.PubDate = i.Published.Format(time.RFC1123Z)
+	}
+
+	if i.Enclosure != nil {
+		r.Enclosure = &rssEnclosure{URL: i.Enclosure.URL, Type: i.Enclosure.Type, Length: i.Enclosure.Length}
+	}
+
+	return r
+}
+
+// atomEntry is an item written into an Atom document, which declares the
+// Atom namespace as its default.
+type atomEntry struct {
+	XMLName    xml.Name       `xml:"entry"`
+	ID         string         `xml:"id"`
+	Title      string         `xml:"title"`
+	Links      []atomLink     `xml:"link"`
+	Published  string         `xml:"published,omitempty"`
+	Updated    string         `xml:"updated"`
+	Summary    string         `xml:"summary,omitempty"`
+	Content    *atomContent   `xml:"content"`
+	Author     *atomPerson    `xml:"author"`
+	Categories []atomCategory `xml:"category"`
+}
+
+type atomLink struct {
+	Rel    string `xml:"rel,attr,omitempty"`
+	Href   string `xml:"href,attr"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+type atomContent struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+func newAtomEntry(i model.Item) atomEntry {
+	e := atomEntry{
+		ID:      i.Key,
+		Title:   i.Title,
+		Summary: i.Description,
+	}
+
+	// Atom requires an update time, the first sighting stands in for it
+	// when the item had no date we could read
+	updated := i.FirstSeen
+	if i.Published != nil {
+		updated = *i.Published
+		e.Published = updated.Format(time.RFC3339)
+	}
+	e.Updated = updated.Format(time.RFC3339)
+
+	if i.Link != "" {
+		e.Links = append(e.Links, atomLink{Rel: "alternate", Href: i.Link})
+	}
+	if i.Enclosure != nil {
+		e.Links = append(e.Links, atomLink{Rel: "enclosure", Href: i.Enclosure.URL, Type: i.Enclosure.Type, Length: i.Enclosure.Length})
+	}
+	if i.Content != "" {
+		e.Content = &atomContent{Type: "html", Value: i.Content}
+	}
+	if i.Author != "" {
+		e.Author = &atomPerson{Name: i.Author}
+	}
+	for _, c := range i.Categories {
+		e.Categories = append(e.Categories, atomCategory{Term: c})
+	}
+
+	return e
+}
+
+const (
+	dcNamespace      = "http://purl.org/dc/elements/1.1/"
+	contentNamespace = "http://purl.org/rss/1.0/modules/content/"
+)
+
+func writeRSS(w http.ResponseWriter, ch rssChannel, items []model.Item) {
+	for _, i := range items {
+		ch.Items = append(ch.Items, newRSSItem(i))
+	}
+
+	doc := rssDocument{
+		Version:   "2.0",
+		DC:        dcNamespace,
+		ContentNS: contentNamespace,
+		Channel:   ch,
+	}
+
+	body, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	body = append([]byte(xml.Header), body...)
+
+	w.Header().Add("Content-Type", "application/rss+xml; charset=utf-8")
+	w.Header().Add("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
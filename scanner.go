@@ -0,0 +1,313 @@
+package backcast
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/leedo/backcast/model"
+)
+
+// scanItem is a feed waiting to be checked, and the job that asked for
+// it if it is not just a scheduled check.
+type scanItem struct {
+	feed model.Feed
+	job  *model.Job
+}
+
+func (a *App) startScanner(ctx context.Context) error {
+	workers := a.config.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	work := make(chan scanItem, workers)
+	done := make(chan scanItem, workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range work {
+				if item.job != nil {
+					if ok, err := a.startJob(ctx, item.job); !ok {
+						if err != nil {
+							log.Printf("failed to start job %d: %v", item.job.ID, err)
+						} else {
+							log.Printf("job %d was claimed by another scanner", item.job.ID)
+						}
+						item.job = nil
+					}
+				}
+
+				ok, err := a.checkFeed(ctx, item.feed)
+				a.limiter.release(feedHost(item.feed.URL))
+				if item.job != nil {
+					if err := a.finishJob(ctx, *item.job, ok, err); err != nil {
+						log.Printf("failed to finish job %d: %v", item.job.ID, err)
+					}
+				}
+				done <- item
+			}
+		}()
+	}
+
+	defer wg.Wait()
+	defer close(work)
+
+	t := time.NewTicker(a.config.ScanInterval)
+	defer t.Stop()
+
+	var (
+		queue    []scanItem
+		inflight = make(map[int64]bool)
+		deferred bool
+	)
+
+	queued := func(id int64) int {
+		for i, item := range queue {
+			if item.feed.ID == id {
+				return i
+			}
+		}
+		return -1
+	}
+
+	// claimJobs moves requested refreshes to the front of the queue. A
+	// feed that is being checked right now gets its job back in the table
+	// and is picked up again once the check is done. A job displaced from
+	// the queue by another for the same feed goes back in the table too,
+	// rather than staying queued until its claim runs out.
+	claimJobs := func() {
+		items, err := a.claimJobs(ctx, a.config.BatchSize)
+		if err != nil {
+			log.Printf("%v", err)
+			return
+		}
+
+		var (
+			front   []scanItem
+			release []model.Job
+		)
+
+		deferred = false
+		for _, item := range items {
+			if inflight[item.feed.ID] {
+				release = append(release, *item.job)
+				deferred = true
+				continue
+			}
+			if i := queued(item.feed.ID); i >= 0 {
+				if old := queue[i].job; old != nil && old.ID != item.job.ID {
+					release = append(release, *old)
+				}
+				queue = append(queue[:i], queue[i+1:]...)
+			}
+			log.Printf("queueing feed %d (%s) for job %d", item.feed.ID, item.feed.URL, item.job.ID)
+			front = append(front, item)
+		}
+
+		queue = append(front, queue...)
+
+		if err := a.releaseJobs(ctx, release); err != nil {
+			log.Printf("%v", err)
+		}
+	}
+
+	claimJobs()
+
+	for {
+		// hand out as much work as there are idle workers, skipping over
+		// feeds whose host is currently out of budget
+		var wait time.Duration
+		for i := 0; i < len(queue) && len(inflight) < workers; {
+			item := queue[i]
+			f := item.feed
+			ok, d := a.limiter.tryAcquire(feedHost(f.URL))
+			if !ok {
+				if wait == 0 || (d > 0 && d < wait) {
+					wait = d
+				}
+				i++
+				continue
+			}
+			queue = append(queue[:i], queue[i+1:]...)
+
+			// feeds queued for a job are not leased yet and others may
+			// have waited long enough for their lease to run out
+			if ok, err := a.claimFeed(ctx, f); !ok {
+				if err != nil {
+					log.Printf("failed to lease feed %d (%s): %v", f.ID, f.URL, err)
+				} else {
+					log.Printf("skipping feed %d (%s), leased by another scanner", f.ID, f.URL)
+				}
+				a.limiter.release(feedHost(f.URL))
+				if item.job != nil {
+					if err := a.releaseJobs(ctx, []model.Job{*item.job}); err != nil {
+						log.Printf("%v", err)
+					}
+				}
+				continue
+			}
+
+			inflight[f.ID] = true
+			work <- item
+		}
+
+		var retry <-chan time.Time
+		if len(queue) > 0 && len(inflight) < workers {
+			if wait <= 0 {
+				wait = 100 * time.Millisecond
+			}
+			retry = time.After(wait)
+		}
+
+		select {
+		case <-a.wake:
+			claimJobs()
+		case item := <-done:
+			delete(inflight, item.feed.ID)
+			if deferred {
+				claimJobs()
+			}
+		case <-retry:
+		case <-t.C:
+			claimJobs()
+			if len(queue) >= a.config.BatchSize {
+				continue
+			}
+			log.Println("scanning for stale feeds")
+			feeds, err := a.findStaleFeeds(ctx)
+			if err != nil {
+				log.Printf("%v", err)
+				continue
+			}
+			for _, f := range feeds {
+				if !inflight[f.ID] && queued(f.ID) < 0 {
+					queue = append(queue, scanItem{feed: f})
+				}
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (a *App) findStaleFeeds(ctx context.Context) ([]model.Feed, error) {
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		return nil, err
+	}
+
+	feeds, err := model.FindStaleFeeds(ctx, time.Now(), a.config.BatchSize, a.config.InstanceID, a.config.LeaseDuration, tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return feeds, tx.Commit()
+}
+
+func (a *App) claimFeed(ctx context.Context, f model.Feed) (bool, error) {
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		return false, err
+	}
+
+	ok, err := f.ClaimLease(ctx, a.config.InstanceID, time.Now(), a.config.LeaseDuration, tx)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	return ok, tx.Commit()
+}
+
+func (a *App) releaseFeed(ctx context.Context, f model.Feed) error {
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		return err
+	}
+
+	if err := f.ReleaseLease(ctx, a.config.InstanceID, tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// holdLease renews the lease on f until the returned stop is called, so a
+// fetch that outlasts the lease duration is not taken over by another
+// scanner. The returned context is cancelled if the lease is lost.
+func (a *App) holdLease(ctx context.Context, f model.Feed) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	go func() {
+		t := time.NewTicker(a.config.LeaseDuration / 3)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+
+			ok, err := a.claimFeed(ctx, f)
+			if err != nil {
+				log.Printf("failed to renew lease on feed %d (%s): %v", f.ID, f.URL, err)
+			} else if !ok {
+				log.Printf("lost lease on feed %d (%s), abandoning check", f.ID, f.URL)
+				cancel()
+				return
+			}
+		}
+	}()
+
+	return ctx, cancel
+}
+
+func (a *App) checkFeed(ctx context.Context, f model.Feed) (bool, error) {
+	fetchCtx, stop := a.holdLease(ctx, f)
+	resp, ok, err := a.updateFeed(fetchCtx, f)
+	lost := fetchCtx.Err() != nil && ctx.Err() == nil
+	stop()
+
+	// whoever holds the lease now schedules the feed
+	if lost {
+		return ok, err
+	}
+
+	if err != nil {
+		log.Printf("failed to update feed %d (%s): %v", f.ID, f.URL, err)
+	}
+	if ok {
+		log.Printf("updated feed %d (%s)", f.ID, f.URL)
+	}
+
+	if err := a.reschedule(ctx, f, ok, err, resp); err != nil {
+		log.Printf("failed to schedule feed %d (%s): %v", f.ID, f.URL, err)
+	}
+
+	if err := a.releaseFeed(ctx, f); err != nil {
+		log.Printf("failed to release feed %d (%s): %v", f.ID, f.URL, err)
+	}
+
+	if err := a.syncSubscription(ctx, f, resp); err != nil {
+		log.Printf("failed to subscribe feed %d (%s): %v", f.ID, f.URL, err)
+	}
+
+	return ok, err
+}
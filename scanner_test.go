@@ -0,0 +1,238 @@
+package backcast
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leedo/backcast/model"
+)
+
+func TestNewAppDefaults(t *testing.T) {
+	a := newTestApp(t, Config{})
+
+	c := a.config
+	if c.ScanInterval <= 0 || c.MinInterval <= 0 || c.MaxInterval <= 0 || c.BatchSize <= 0 || c.LeaseDuration <= 0 || c.Workers <= 0 {
+		t.Errorf("zero config was not given defaults: %+v", c)
+	}
+}
+
+// hostLoad counts requests per host and the most that were in flight to
+// one host at a time.
+type hostLoad struct {
+	mu       sync.Mutex
+	total    int
+	active   map[string]int
+	peak     map[string]int
+	requests map[string]int
+}
+
+func (l *hostLoad) handler(delay time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.Split(r.Host, ":")[0]
+
+		l.mu.Lock()
+		l.total++
+		l.requests[host]++
+		l.active[host]++
+		if l.active[host] > l.peak[host] {
+			l.peak[host] = l.active[host]
+		}
+		l.mu.Unlock()
+
+		time.Sleep(delay)
+
+		l.mu.Lock()
+		l.active[host]--
+		l.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprintf(w, `<rss version="2.0"><channel><title>%s</title></channel></rss>`, r.URL.Path)
+	})
+}
+
+func (l *hostLoad) served() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.total
+}
+
+// TestScannerLoad runs the scanner over hundreds of feeds spread across
+// two hosts, and checks every feed is fetched once without going over
+// the per-host connection cap.
+func TestScannerLoad(t *testing.T) {
+	if testing.Short() {
+		t.Skip("load test")
+	}
+
+	const (
+		feeds     = 400
+		hostConns = 3
+		workers   = 16
+		delay     = 5 * time.Millisecond
+	)
+
+	load := &hostLoad{
+		active:   make(map[string]int),
+		peak:     make(map[string]int),
+		requests: make(map[string]int),
+	}
+
+	srv := httptest.NewServer(load.handler(delay))
+	defer srv.Close()
+
+	port := srv.Listener.Addr().String()
+	port = port[strings.LastIndexByte(port, ':'):]
+
+	a := newTestApp(t, Config{
+		Workers:      workers,
+		BatchSize:    100,
+		ScanInterval: 20 * time.Millisecond,
+		HostConns:    hostConns,
+	})
+
+	hosts := []string{"127.0.0.1", "localhost"}
+	for i := 0; i < feeds; i++ {
+		addTestFeed(t, a, fmt.Sprintf("http://%s%s/feed/%d", hosts[i%len(hosts)], port, i))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	start := time.Now()
+	go func() {
+		a.startScanner(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(30 * time.Second)
+	for load.served() < feeds && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	elapsed := time.Since(start)
+
+	// let a late duplicate show up before stopping
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+
+	load.mu.Lock()
+	defer load.mu.Unlock()
+
+	if load.total != feeds {
+		t.Fatalf("served %d requests for %d feeds", load.total, feeds)
+	}
+
+	for _, host := range hosts {
+		if load.peak[host] > hostConns {
+			t.Errorf("%d concurrent requests to %s, limit is %d", load.peak[host], host, hostConns)
+		}
+		t.Logf("%s: %d requests, at most %d at a time", host, load.requests[host], load.peak[host])
+	}
+
+	t.Logf("fetched %d feeds in %s, %.0f feeds/s with %d workers", feeds, elapsed.Round(time.Millisecond), float64(feeds)/elapsed.Seconds(), workers)
+}
+
+// TestLeaseRenewedDuringFetch checks a fetch slower than the lease keeps
+// the feed leased, and that a read does not block the commit meanwhile.
+func TestLeaseRenewedDuringFetch(t *testing.T) {
+	const lease = 300 * time.Millisecond
+
+	var (
+		a       *App
+		f       model.Feed
+		expires = make(chan *time.Time, 1)
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a reader holding a transaction open over the fetch
+		tx, err := a.db.Begin()
+		if err == nil {
+			defer tx.Rollback()
+			model.GetFeed(r.Context(), strconv.FormatInt(f.ID, 10), tx)
+		}
+
+		time.Sleep(3 * lease)
+
+		var e *time.Time
+		a.db.QueryRow(`SELECT lease_expires FROM feed WHERE id=?`, f.ID).Scan(&e)
+		expires <- e
+
+		w.Write([]byte(testFeed))
+	}))
+	defer srv.Close()
+
+	a = newTestApp(t, Config{LeaseDuration: lease})
+	f = addTestFeed(t, a, srv.URL+"/feed.xml")
+	ctx := context.Background()
+
+	if ok, err := a.claimFeed(ctx, f); !ok || err != nil {
+		t.Fatalf("claim: %v %v", ok, err)
+	}
+
+	start := time.Now()
+	if ok, err := a.checkFeed(ctx, f); !ok || err != nil {
+		t.Fatalf("check: %v %v", ok, err)
+	}
+
+	if e := <-expires; e == nil || !e.After(start.Add(lease)) {
+		t.Errorf("lease expired at %v during a fetch started at %v, want it renewed", e, start)
+	}
+
+	if f = reloadFeed(t, a, f); f.LeaseOwner != "" {
+		t.Errorf("lease still held by %q after the check", f.LeaseOwner)
+	}
+}
+
+// TestAPIWritesTakeWriteLock checks API writes queue behind the scanner's
+// writes instead of racing them in deferred transactions.
+func TestAPIWritesTakeWriteLock(t *testing.T) {
+	a := newTestApp(t, Config{})
+	f := addTestFeed(t, a, "http://example.com/feed.xml")
+	id := strconv.FormatInt(f.ID, 10)
+	router := a.routes()
+
+	for _, c := range []struct{ method, path, body string }{
+		{"PATCH", "/api/feed/" + id, ""},
+		{"POST", "/api/feed", `{"url":"http://example.com/other.xml"}`},
+		{"PUT", "/api/feed/" + id + "/options", `{}`},
+		{"PUT", "/api/feed/" + id + "/schedule", `{}`},
+		{"DELETE", "/api/feed/" + id + "/credentials", ""},
+		{"DELETE", "/api/feed/" + id + "/tls", ""},
+		{"DELETE", "/api/feed/" + id + "/cookies", ""},
+		{"PUT", "/api/feed/" + id + "/rules", `[]`},
+		{"PUT", "/api/admin/hosts/example.com", `{"rate":1}`},
+	} {
+		a.writeLock.Lock()
+
+		done := make(chan int)
+		go func() {
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(c.method, c.path, strings.NewReader(c.body)))
+			done <- rec.Code
+		}()
+
+		select {
+		case code := <-done:
+			t.Errorf("%s %s answered %d while the write lock was held", c.method, c.path, code)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		a.writeLock.Unlock()
+
+		select {
+		case code := <-done:
+			if code != http.StatusOK {
+				t.Errorf("%s %s answered %d", c.method, c.path, code)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s %s did not finish", c.method, c.path)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package backcast
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/leedo/backcast/model"
+)
+
+const scheduleJitter = 0.1
+
+func (a *App) scheduleBounds(f model.Feed) (time.Duration, time.Duration) {
+	min := time.Duration(f.Schedule.MinInterval) * time.Second
+	if min <= 0 {
+		min = a.config.MinInterval
+	}
+
+	max := time.Duration(f.Schedule.MaxInterval) * time.Second
+	if max <= 0 {
+		max = a.config.MaxInterval
+	}
+
+	if max < min {
+		max = min
+	}
+
+	return min, max
+}
+
+// reboundSchedule fits a feed's pending check into changed interval
+// bounds, measured from its last check, so that lowering the maximum
+// takes effect without waiting out the old interval.
+func (a *App) reboundSchedule(f model.Feed, now time.Time) model.Schedule {
+	s := f.Schedule
+	min, max := a.scheduleBounds(f)
+
+	if interval := time.Duration(s.Interval) * time.Second; interval > 0 {
+		if interval < min {
+			interval = min
+		} else if interval > max {
+			interval = max
+		}
+		s.Interval = int64(interval / time.Second)
+	}
+
+	// a feed that was never checked is already due
+	if s.NextCheckAt == nil || f.LastUpdate == nil {
+		return s
+	}
+
+	next := *s.NextCheckAt
+	if latest := f.LastUpdate.Add(max); next.After(latest) {
+		next = latest
+		s.Reason += ", moved up to the new maximum interval"
+	} else if earliest := f.LastUpdate.Add(min); next.Before(earliest) && earliest.After(now) {
+		next = earliest
+		s.Reason += ", moved back to the new minimum interval"
+	}
+	s.NextCheckAt = &next
+
+	return s
+}
+
+// nextSchedule aims to poll about twice per observed change: every change
+// pulls the interval toward half the time since the previous change, and
+// every unchanged check backs off by half again, within the feed's bounds.
+func (a *App) nextSchedule(f model.Feed, changed bool, failed bool, resp *FetchResponse, now time.Time) model.Schedule {
+	min, max := a.scheduleBounds(f)
+	prev := time.Duration(f.Schedule.Interval) * time.Second
+
+	var (
+		interval time.Duration
+		reason   string
+	)
+
+	switch {
+	case prev == 0:
+		interval = min
+		reason = "first check"
+	case changed && f.LastChangeAt != nil:
+		gap := now.Sub(*f.LastChangeAt)
+		interval = (prev + gap/2) / 2
+		reason = fmt.Sprintf("changed %s after previous change", gap.Round(time.Minute))
+	case changed:
+		interval = prev / 2
+		reason = "changed"
+	default:
+		interval = prev * 3 / 2
+		reason = "unchanged, backing off"
+	}
+
+	if interval < min {
+		interval = min
+		reason += ", held at minimum interval"
+	} else if interval > max {
+		interval = max
+		reason += ", held at maximum interval"
+	}
+
+	// failures back off exponentially from the regular interval without
+	// changing it, so a feed that recovers goes back to its old schedule
+	delay := interval
+	if failed {
+		for i := int64(0); i < f.FailureCount+1 && delay < max; i++ {
+			delay *= 2
+		}
+		if delay > max {
+			delay = max
+		}
+		reason = fmt.Sprintf("failed %d times in a row, backing off %s", f.FailureCount+1, delay.Round(time.Second))
+	}
+
+	jitter := time.Duration((rand.Float64()*2 - 1) * scheduleJitter * float64(delay))
+	next := now.Add(delay + jitter)
+
+	hints := f.Schedule.Hints
+	if resp != nil && len(resp.Body) > 0 {
+		hints = parseBodyHints(resp.Body)
+	}
+
+	if a.config.IgnoreHints || f.Schedule.IgnoreHints {
+		reason += ", ignoring publisher hints"
+	} else {
+		next, reason = applyHints(next, reason, hints, resp, max, now)
+	}
+
+	return model.Schedule{
+		NextCheckAt: &next,
+		Interval:    int64(interval / time.Second),
+		MinInterval: f.Schedule.MinInterval,
+		MaxInterval: f.Schedule.MaxInterval,
+		Reason:      reason,
+		Hints:       hints,
+		IgnoreHints: f.Schedule.IgnoreHints,
+	}
+}
+
+// applyHints never lets a publisher hint push the next check further out
+// than the feed's maximum interval.
+func applyHints(next time.Time, reason string, hints model.Hints, resp *FetchResponse, max time.Duration, now time.Time) (time.Time, string) {
+	var (
+		delay  time.Duration
+		source string
+	)
+
+	if resp != nil {
+		delay, source = headerDelay(resp.Header, resp.StatusCode, now)
+	}
+	if d := time.Duration(hints.TTL) * time.Second; d > delay {
+		delay, source = d, "ttl"
+	}
+	if d := time.Duration(hints.UpdatePeriod) * time.Second; d > delay {
+		delay, source = d, "sy:updatePeriod"
+	}
+
+	if delay > max {
+		delay = max
+	}
+
+	if t := now.Add(delay); t.After(next) {
+		next = t
+		reason += fmt.Sprintf(", delayed %s by %s", delay.Round(time.Second), source)
+	}
+
+	if t := skipWindow(next, hints); !t.Equal(next) {
+		next = t
+		reason += ", moved past skipHours/skipDays"
+	}
+
+	return next, reason
+}
+
+func (a *App) reschedule(ctx context.Context, f model.Feed, changed bool, fetchErr error, resp *FetchResponse) error {
+	disallowed := errors.Is(fetchErr, errRobotsDisallowed)
+	s := a.nextSchedule(f, changed, fetchErr != nil && !disallowed, resp, time.Now())
+
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		return err
+	}
+
+	if disallowed {
+		_, max := a.scheduleBounds(f)
+		next := time.Now().Add(max)
+		s.NextCheckAt = &next
+		s.Reason = "disallowed by robots.txt"
+		if err := f.SetStatus(ctx, model.StatusDisallowed, tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	} else if fetchErr != nil {
+		status := f.Status
+		if resp != nil && resp.StatusCode == http.StatusGone {
+			status = model.StatusGone
+			s.Reason = "feed is gone"
+			log.Printf("feed %d (%s) is gone", f.ID, f.URL)
+		} else if a.config.MaxFailures > 0 && f.FailureCount+1 >= int64(a.config.MaxFailures) {
+			status = model.StatusSuspended
+			s.Reason = fmt.Sprintf("suspended after %d consecutive failures", f.FailureCount+1)
+			log.Printf("suspending feed %d (%s): %s", f.ID, f.URL, s.Reason)
+		}
+		if status == "" {
+			status = model.StatusActive
+		}
+		if err := f.RecordFailure(ctx, classifyError(fetchErr, resp), fetchErr.Error(), status, tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	} else if err := f.ClearFailures(ctx, tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := f.UpdateSchedule(ctx, s, tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
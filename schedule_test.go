@@ -0,0 +1,43 @@
+package backcast
+
+import (
+	"testing"
+	"time"
+
+	"github.com/leedo/backcast/model"
+)
+
+func TestReboundSchedule(t *testing.T) {
+	a := &App{config: Config{}.withDefaults()}
+
+	now := time.Now()
+	last := now.Add(-10 * time.Minute)
+	next := last.Add(24 * time.Hour)
+
+	f := model.Feed{
+		LastUpdate: &last,
+		Schedule: model.Schedule{
+			NextCheckAt: &next,
+			Interval:    int64(24 * time.Hour / time.Second),
+			MaxInterval: int64(time.Hour / time.Second),
+		},
+	}
+
+	s := a.reboundSchedule(f, now)
+	if want := last.Add(time.Hour); !s.NextCheckAt.Equal(want) {
+		t.Errorf("next check at %v, want %v", s.NextCheckAt, want)
+	}
+	if s.Interval != int64(time.Hour/time.Second) {
+		t.Errorf("interval %d, want it clamped to an hour", s.Interval)
+	}
+
+	// a higher minimum pushes back a check that is not yet due
+	soon := now.Add(time.Minute)
+	f.Schedule.NextCheckAt = &soon
+	f.Schedule.MinInterval = int64(30 * time.Minute / time.Second)
+
+	s = a.reboundSchedule(f, now)
+	if want := last.Add(30 * time.Minute); !s.NextCheckAt.Equal(want) {
+		t.Errorf("next check at %v, want %v", s.NextCheckAt, want)
+	}
+}
@@ -48,6 +48,242 @@ CREATE TABLE history (
 
 	migrate(`
 CREATE UNIQUE INDEX idx_feed ON history(feed, id);
+`)
+
+	migrate(`
+ALTER TABLE history ADD COLUMN last_modified VARCHAR(255);
+ALTER TABLE feed ADD COLUMN last_status INTEGER;
+`)
+
+	migrate(`
+CREATE TABLE fetch_options (
+    feed INTEGER PRIMARY KEY NOT NULL,
+    user_agent VARCHAR(255) NOT NULL DEFAULT '',
+    proxy VARCHAR(2048) NOT NULL DEFAULT '',
+    timeout INTEGER NOT NULL DEFAULT 0,
+    max_body_size INTEGER NOT NULL DEFAULT 0,
+    updated_at DATETIME NOT NULL
+)`)
+
+	migrate(`
+CREATE TABLE host_limit (
+    host VARCHAR(255) PRIMARY KEY NOT NULL,
+    rate REAL NOT NULL DEFAULT 0,
+    burst INTEGER NOT NULL DEFAULT 0,
+    max_conns INTEGER NOT NULL DEFAULT 0,
+    updated_at DATETIME NOT NULL
+)`)
+
+	migrate(`
+ALTER TABLE feed ADD COLUMN next_check_at DATETIME;
+ALTER TABLE feed ADD COLUMN last_change_at DATETIME;
+ALTER TABLE feed ADD COLUMN check_interval INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE feed ADD COLUMN min_interval INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE feed ADD COLUMN max_interval INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE feed ADD COLUMN schedule_reason VARCHAR(255) NOT NULL DEFAULT '';
+CREATE INDEX idx_next_check_at ON feed(next_check_at);
+`)
+
+	migrate(`
+ALTER TABLE feed ADD COLUMN hints TEXT;
+ALTER TABLE feed ADD COLUMN ignore_hints INTEGER NOT NULL DEFAULT 0;
+`)
+
+	migrate(`
+ALTER TABLE feed ADD COLUMN status VARCHAR(32) NOT NULL DEFAULT 'active';
+ALTER TABLE feed ADD COLUMN failure_count INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE feed ADD COLUMN last_error TEXT NOT NULL DEFAULT '';
+ALTER TABLE feed ADD COLUMN last_error_class VARCHAR(32) NOT NULL DEFAULT '';
+ALTER TABLE feed ADD COLUMN last_error_at DATETIME;
+CREATE INDEX idx_status ON feed(status);
+`)
+
+	migrate(`
+CREATE TABLE feed_url (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    feed INTEGER NOT NULL,
+    url VARCHAR(2048) NOT NULL,
+    new_url VARCHAR(2048) NOT NULL,
+    reason VARCHAR(255) NOT NULL,
+    created_at DATETIME NOT NULL
+);
+CREATE INDEX idx_feed_url_url ON feed_url(url);
+CREATE INDEX idx_feed_url_feed ON feed_url(feed, id);
+`)
+
+	migrate(`
+ALTER TABLE feed ADD COLUMN podcast_guid VARCHAR(255) NOT NULL DEFAULT '';
+CREATE INDEX idx_podcast_guid ON feed(podcast_guid);
+CREATE TABLE feed_move_refusal (
+    feed INTEGER NOT NULL,
+    url VARCHAR(2048) NOT NULL,
+    reason TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (feed, url)
+);
+`)
+
+	migrate(`
+CREATE TABLE feed_credential (
+    feed INTEGER PRIMARY KEY NOT NULL,
+    kind VARCHAR(32) NOT NULL,
+    data BLOB NOT NULL,
+    updated_at DATETIME NOT NULL
+)`)
+
+	migrate(`
+ALTER TABLE fetch_options ADD COLUMN ignore_robots INTEGER NOT NULL DEFAULT 0;
+`)
+
+	migrate(`
+ALTER TABLE history ADD COLUMN charset VARCHAR(32) NOT NULL DEFAULT '';
+ALTER TABLE history ADD COLUMN transcoded INTEGER NOT NULL DEFAULT 0;
+`)
+
+	migrate(`
+CREATE TABLE websub_subscription (
+    feed INTEGER PRIMARY KEY NOT NULL,
+    hub TEXT NOT NULL,
+    topic TEXT NOT NULL,
+    secret BLOB,
+    state VARCHAR(16) NOT NULL,
+    lease_seconds INTEGER NOT NULL DEFAULT 0,
+    expires_at DATETIME,
+    renew_at DATETIME,
+    last_error TEXT NOT NULL DEFAULT '',
+    updated_at DATETIME NOT NULL
+);
+CREATE INDEX idx_websub_renew_at ON websub_subscription (state, renew_at);
+`)
+
+	migrate(`
+ALTER TABLE feed ADD COLUMN lease_owner VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE feed ADD COLUMN lease_expires DATETIME;
+`)
+
+	migrate(`
+CREATE TABLE job (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    feed INTEGER NOT NULL,
+    priority INTEGER NOT NULL DEFAULT 0,
+    reason VARCHAR(32) NOT NULL DEFAULT '',
+    status VARCHAR(16) NOT NULL,
+    owner VARCHAR(255) NOT NULL DEFAULT '',
+    changed INTEGER NOT NULL DEFAULT 0,
+    error TEXT NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL,
+    claimed_at DATETIME,
+    started_at DATETIME,
+    finished_at DATETIME
+);
+CREATE INDEX idx_job_status ON job (status, priority);
+CREATE INDEX idx_job_feed ON job (feed, status);
+`)
+
+	migrate(`
+CREATE TABLE tls_option (
+    scope VARCHAR(8) NOT NULL,
+    target VARCHAR(255) NOT NULL,
+    ca TEXT NOT NULL DEFAULT '',
+    cert TEXT NOT NULL DEFAULT '',
+    key BLOB,
+    pins TEXT NOT NULL DEFAULT '',
+    insecure INTEGER NOT NULL DEFAULT 0,
+    updated_at DATETIME NOT NULL,
+    PRIMARY KEY (scope, target)
+)`)
+
+	migrate(`
+ALTER TABLE fetch_options ADD COLUMN cookies INTEGER NOT NULL DEFAULT 0;
+CREATE TABLE cookie (
+    domain VARCHAR(255) NOT NULL,
+    path VARCHAR(255) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    value TEXT NOT NULL,
+    host_only INTEGER NOT NULL DEFAULT 0,
+    secure INTEGER NOT NULL DEFAULT 0,
+    http_only INTEGER NOT NULL DEFAULT 0,
+    expires DATETIME,
+    updated_at DATETIME NOT NULL,
+    PRIMARY KEY (domain, path, name)
+);
+CREATE INDEX idx_cookie_expires ON cookie (expires);
+`)
+
+	migrate(`
+CREATE TABLE feed_channel (
+    feed INTEGER NOT NULL,
+    revision INTEGER NOT NULL,
+    format VARCHAR(16) NOT NULL DEFAULT '',
+    title TEXT NOT NULL DEFAULT '',
+    link TEXT NOT NULL DEFAULT '',
+    description TEXT NOT NULL DEFAULT '',
+    language VARCHAR(32) NOT NULL DEFAULT '',
+    item_count INTEGER NOT NULL DEFAULT 0,
+    parse_error TEXT,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (feed, revision)
+);
+CREATE TABLE item (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    feed INTEGER NOT NULL,
+    key TEXT NOT NULL,
+    first_revision INTEGER NOT NULL,
+    last_revision INTEGER NOT NULL,
+    position INTEGER NOT NULL,
+    created_at DATETIME NOT NULL
+);
+CREATE UNIQUE INDEX idx_item_key ON item (feed, key);
+CREATE INDEX idx_item_last_revision ON item (feed, last_revision);
+CREATE TABLE item_version (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    item INTEGER NOT NULL,
+    revision INTEGER NOT NULL,
+    checksum VARCHAR(40) NOT NULL,
+    guid TEXT NOT NULL DEFAULT '',
+    title TEXT NOT NULL DEFAULT '',
+    link TEXT NOT NULL DEFAULT '',
+    pub_date VARCHAR(64) NOT NULL DEFAULT '',
+    published DATETIME,
+    description TEXT NOT NULL DEFAULT '',
+    content TEXT NOT NULL DEFAULT '',
+    author TEXT NOT NULL DEFAULT '',
+    enclosure_url TEXT NOT NULL DEFAULT '',
+    enclosure_type VARCHAR(255) NOT NULL DEFAULT '',
+    enclosure_length INTEGER NOT NULL DEFAULT 0,
+    raw TEXT NOT NULL DEFAULT '',
+    format VARCHAR(16) NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL
+);
+CREATE INDEX idx_item_version ON item_version (item, id);
+CREATE TABLE item_category (
+    version INTEGER NOT NULL,
+    category TEXT NOT NULL
+);
+CREATE INDEX idx_item_category ON item_category (version);
+`)
+
+	migrate(`
+CREATE TABLE item_removal (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    item INTEGER NOT NULL,
+    version INTEGER NOT NULL,
+    revision INTEGER NOT NULL,
+    restored_revision INTEGER,
+    created_at DATETIME NOT NULL
+);
+CREATE INDEX idx_item_removal ON item_removal (item);
+`)
+
+	migrate(`
+ALTER TABLE history ADD COLUMN raw_diff TEXT NOT NULL DEFAULT '';
+ALTER TABLE history ADD COLUMN raw_checksum VARCHAR(40) NOT NULL DEFAULT '';
+ALTER TABLE history ADD COLUMN suppressed INTEGER NOT NULL DEFAULT 0;
+CREATE TABLE normalize_rules (
+    feed INTEGER PRIMARY KEY NOT NULL,
+    rules TEXT NOT NULL,
+    updated_at DATETIME NOT NULL
+);
 `)
 }
 
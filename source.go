@@ -0,0 +1,266 @@
+package backcast
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/leedo/backcast/model"
+)
+
+// SourceRequest describes one fetch of a feed. Etag and LastModified are
+// the validators of the current revision, so a source can answer with
+// http.StatusNotModified when nothing changed.
+type SourceRequest struct {
+	Feed         model.Feed
+	URL          *url.URL
+	Etag         string
+	LastModified string
+	Options      model.FetchOptions
+
+	credentials *credentials
+	tls         *tlsSettings
+	cookies     *cookieJar
+}
+
+// A Source fetches feeds for one URL scheme. A successful fetch returns a
+// response with StatusCode set to http.StatusOK and the feed in Body.
+type Source interface {
+	Fetch(ctx context.Context, req SourceRequest) (*FetchResponse, error)
+}
+
+// SourceFunc adapts a function to the Source interface.
+type SourceFunc func(ctx context.Context, req SourceRequest) (*FetchResponse, error)
+
+func (fn SourceFunc) Fetch(ctx context.Context, req SourceRequest) (*FetchResponse, error) {
+	return fn(ctx, req)
+}
+
+// RegisterSource makes feeds with URLs using scheme fetch through s,
+// replacing any source already registered for it.
+func (a *App) RegisterSource(scheme string, s Source) {
+	a.sources[strings.ToLower(scheme)] = s
+}
+
+func (a *App) source(rawurl string) (Source, *url.URL, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s, ok := a.sources[strings.ToLower(u.Scheme)]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported feed URL scheme %q", u.Scheme)
+	}
+
+	return s, u, nil
+}
+
+func (a *App) registerSources() {
+	a.sources = make(map[string]Source)
+
+	h := httpSource{a.fetcher}
+	a.RegisterSource("http", h)
+	a.RegisterSource("https", h)
+
+	if len(a.config.FileRoots) > 0 {
+		a.RegisterSource("file", fileSource{a.config})
+	}
+	if len(a.config.Commands) > 0 {
+		a.RegisterSource("exec", execSource{a.config})
+	}
+}
+
+type httpSource struct {
+	fetcher *fetcher
+}
+
+func (s httpSource) Fetch(ctx context.Context, sr SourceRequest) (*FetchResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", sr.URL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if sr.Etag != "" {
+		req.Header.Set("If-None-Match", sr.Etag)
+	}
+	if sr.LastModified != "" {
+		req.Header.Set("If-Modified-Since", sr.LastModified)
+	}
+
+	return s.fetcher.fetch(ctx, req, feedSettings{sr.Options, sr.credentials, sr.tls, sr.cookies})
+}
+
+func bodyLimit(c Config, o model.FetchOptions) int64 {
+	if o.MaxBodySize > 0 {
+		return o.MaxBodySize
+	}
+	return c.MaxBodySize
+}
+
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	if limit > 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, bodyError{err}
+	}
+
+	if limit > 0 && int64(len(b)) > limit {
+		return nil, bodyError{fmt.Errorf("response body exceeds %d bytes", limit)}
+	}
+
+	return b, nil
+}
+
+// fileSource reads feeds from local files, which must be below one of the
+// configured roots so the API cannot be used to read arbitrary files.
+type fileSource struct {
+	config Config
+}
+
+// resolve follows symlinks in path and in each root before checking
+// containment, so a link below a root cannot point the source outside it.
+func (s fileSource) resolve(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("%s is not below an allowed file root", path)
+	}
+
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+
+	for _, root := range s.config.FileRoots {
+		root, err := filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+		if root, err = filepath.EvalSymlinks(root); err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(root, real); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return real, nil
+		}
+	}
+
+	return "", fmt.Errorf("%s is not below an allowed file root", path)
+}
+
+func (s fileSource) Fetch(ctx context.Context, sr SourceRequest) (*FetchResponse, error) {
+	path, err := s.resolve(filepath.Clean(filepath.FromSlash(sr.URL.Path)))
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	modified := info.ModTime().UTC().Format(http.TimeFormat)
+	header := http.Header{"Last-Modified": {modified}}
+	if ct := mime.TypeByExtension(filepath.Ext(path)); ct != "" {
+		header.Set("Content-Type", ct)
+	}
+
+	if sr.LastModified == modified {
+		return &FetchResponse{StatusCode: http.StatusNotModified, Status: "304 Not Modified", Header: header}, nil
+	}
+
+	body, err := readLimited(file, bodyLimit(s.config, sr.Options))
+	if err != nil {
+		return nil, err
+	}
+
+	return &FetchResponse{StatusCode: http.StatusOK, Status: "200 OK", Header: header, Body: body}, nil
+}
+
+// execSource runs a command configured on the command line and archives
+// its output. The host of an exec:// URL names the command, so feeds can
+// only run what the operator has set up.
+type execSource struct {
+	config Config
+}
+
+func (s execSource) Fetch(ctx context.Context, sr SourceRequest) (*FetchResponse, error) {
+	name := sr.URL.Host
+	if name == "" {
+		name = sr.URL.Opaque
+	}
+
+	args, ok := s.config.Commands[name]
+	if !ok || len(args) == 0 {
+		return nil, fmt.Errorf("no command configured for %q", name)
+	}
+
+	timeout := s.config.ReadTimeout
+	if sr.Options.Timeout > 0 {
+		timeout = sr.Options.TimeoutDuration()
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = &stderr
+	cmd.Env = append(os.Environ(),
+		"BACKCAST_FEED_ID="+strconv.FormatInt(sr.Feed.ID, 10),
+		"BACKCAST_FEED_URL="+sr.Feed.URL,
+	)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	body, readErr := readLimited(stdout, bodyLimit(s.config, sr.Options))
+	if readErr != nil {
+		// stop a command that keeps writing past the limit
+		cmd.Process.Kill()
+	}
+
+	// a command that failed on its own explains more than the empty or
+	// oversized output it left behind
+	var exitErr *exec.ExitError
+	if err := cmd.Wait(); err != nil && (readErr == nil || errors.As(err, &exitErr) && exitErr.Exited()) {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %v: %s", name, err, msg)
+		}
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	return &FetchResponse{StatusCode: http.StatusOK, Status: "200 OK", Header: http.Header{}, Body: body}, nil
+}
@@ -0,0 +1,69 @@
+package backcast
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSourceSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "feeds")
+	outside := filepath.Join(dir, "secret")
+
+	for _, d := range []string{root, outside} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(root, "feed.xml"), []byte(testFeed), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(outside, "passwd"), []byte("root:x:0:0"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a link to a file and one to a directory outside the root
+	if err := os.Symlink(filepath.Join(outside, "passwd"), filepath.Join(root, "passwd.xml")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the configured root is itself reached through a link
+	linkedRoot := filepath.Join(dir, "linked")
+	if err := os.Symlink(root, linkedRoot); err != nil {
+		t.Fatal(err)
+	}
+
+	s := fileSource{Config{FileRoots: []string{linkedRoot}}}
+
+	fetch := func(path string) error {
+		_, err := s.Fetch(context.Background(), SourceRequest{URL: &url.URL{Scheme: "file", Path: path}})
+		return err
+	}
+
+	for _, path := range []string{
+		filepath.Join(root, "feed.xml"),
+		filepath.Join(linkedRoot, "feed.xml"),
+	} {
+		if err := fetch(path); err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+	}
+
+	for _, path := range []string{
+		filepath.Join(root, "passwd.xml"),
+		filepath.Join(root, "escape", "passwd"),
+		filepath.Join(linkedRoot, "..", "secret", "passwd"),
+	} {
+		if err := fetch(path); err == nil {
+			t.Errorf("%s was read from outside the root", path)
+		}
+	}
+}
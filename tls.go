@@ -0,0 +1,364 @@
+package backcast
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/leedo/backcast/model"
+)
+
+const pinPrefix = "sha256/"
+
+// tlsSettings are stored TLS options with the client key decrypted, ready
+// for the fetcher. They apply to the whole request, so a redirect to
+// another host is verified against the same roots and pins.
+type tlsSettings struct {
+	CA       string   `json:"ca,omitempty"`
+	Cert     string   `json:"cert,omitempty"`
+	Key      string   `json:"key,omitempty"`
+	Pins     []string `json:"pins,omitempty"`
+	Insecure bool     `json:"insecure_skip_verify"`
+}
+
+// fingerprint identifies the settings, so the fetcher can share one
+// transport between feeds configured the same way.
+func (t *tlsSettings) fingerprint() string {
+	if t == nil {
+		return ""
+	}
+	b, _ := json.Marshal(t)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func (t *tlsSettings) config() (*tls.Config, error) {
+	c := &tls.Config{InsecureSkipVerify: t.Insecure}
+
+	if t.CA != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(t.CA)) {
+			return nil, fmt.Errorf("no certificates found in CA bundle")
+		}
+		c.RootCAs = pool
+	}
+
+	if t.Cert != "" {
+		pair, err := tls.X509KeyPair([]byte(t.Cert), []byte(t.Key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %v", err)
+		}
+		c.Certificates = []tls.Certificate{pair}
+	}
+
+	if len(t.Pins) > 0 {
+		pins := make(map[string]bool)
+		for _, p := range t.Pins {
+			pins[p] = true
+		}
+		// runs after the usual verification, and even when it is skipped.
+		// The presented chain is whatever the server chose to send, so only
+		// certificates in a verified chain count, or the leaf alone when
+		// verification is skipped.
+		insecure := t.Insecure
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			var chains [][]*x509.Certificate
+			if insecure {
+				if len(cs.PeerCertificates) > 0 {
+					chains = [][]*x509.Certificate{cs.PeerCertificates[:1]}
+				}
+			} else {
+				chains = cs.VerifiedChains
+			}
+
+			for _, chain := range chains {
+				for _, cert := range chain {
+					if pins[spkiPin(cert)] {
+						return nil
+					}
+				}
+			}
+			return fmt.Errorf("no certificate presented by %s matches a pinned key", cs.ServerName)
+		}
+	}
+
+	return c, nil
+}
+
+func spkiPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return pinPrefix + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// normalizePin accepts a base64 SHA-256 of a SubjectPublicKeyInfo, with or
+// without the sha256/ prefix used by HPKP and curl.
+func normalizePin(pin string) (string, error) {
+	pin = strings.TrimPrefix(strings.TrimSpace(pin), pinPrefix)
+	b, err := base64.StdEncoding.DecodeString(pin)
+	if err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("pin %q is not a base64 encoded SHA-256 hash", pin)
+	}
+	return pinPrefix + pin, nil
+}
+
+// validate checks the settings parse and normalizes the pins.
+func (t *tlsSettings) validate() error {
+	if t.Key != "" && t.Cert == "" {
+		return fmt.Errorf("a client key needs a certificate")
+	}
+	if t.Cert != "" && t.Key == "" {
+		return fmt.Errorf("a client certificate needs a key")
+	}
+	if t.CA != "" {
+		if block, _ := pem.Decode([]byte(t.CA)); block == nil {
+			return fmt.Errorf("CA bundle is not PEM encoded")
+		}
+	}
+
+	for i, p := range t.Pins {
+		pin, err := normalizePin(p)
+		if err != nil {
+			return err
+		}
+		t.Pins[i] = pin
+	}
+
+	_, err := t.config()
+	return err
+}
+
+func tlsKeyContext(scope, target string) []byte {
+	return sealContext("tls-key", scope+":"+target)
+}
+
+func (a *App) openTLSOptions(o model.TLSOptions, scope, target string) (*tlsSettings, error) {
+	t := &tlsSettings{
+		CA:       o.CA,
+		Cert:     o.Cert,
+		Pins:     o.Pins,
+		Insecure: o.Insecure,
+	}
+
+	if o.HasKey {
+		key, err := a.sealer.open(o.Key, tlsKeyContext(scope, target))
+		if err != nil {
+			return nil, fmt.Errorf("could not decrypt client key: %v", err)
+		}
+		t.Key = string(key)
+	}
+
+	return t, nil
+}
+
+// loadTLSSettings returns the feed's own TLS options, or else those of its
+// host, or nil when neither is configured.
+func (a *App) loadTLSSettings(ctx context.Context, f model.Feed, tx *sql.Tx) (*tlsSettings, error) {
+	scope, target := model.TLSScopeFeed, f.TLSTarget()
+	o, err := model.GetTLSOptions(ctx, scope, target, tx)
+	if err == sql.ErrNoRows {
+		scope, target = model.TLSScopeHost, feedHost(f.URL)
+		o, err = model.GetTLSOptions(ctx, scope, target, tx)
+	}
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return a.openTLSOptions(o, scope, target)
+}
+
+func (a *App) getTLSOptions(w http.ResponseWriter, r *http.Request, scope, target string) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	defer tx.Rollback()
+
+	o, err := model.GetTLSOptions(r.Context(), scope, target, tx)
+	if err != nil && err != sql.ErrNoRows {
+		jsonError(err, w)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(o); err != nil {
+		jsonError(err, w)
+		return
+	}
+}
+
+// setTLSOptions replaces the stored options. A request that leaves out the
+// key keeps the stored one, so pins can change without resending it.
+func (a *App) setTLSOptions(w http.ResponseWriter, r *http.Request, scope, target string) {
+	ctx := r.Context()
+
+	var t tlsSettings
+
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&t); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	defer tx.Rollback()
+
+	stored, err := model.GetTLSOptions(ctx, scope, target, tx)
+	if err != nil && err != sql.ErrNoRows {
+		jsonError(err, w)
+		return
+	}
+
+	if t.Key == "" && t.Cert != "" && stored.HasKey {
+		old, err := a.openTLSOptions(stored, scope, target)
+		if err != nil {
+			jsonError(err, w)
+			return
+		}
+		t.Key = old.Key
+	}
+
+	if err := t.validate(); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	o := model.TLSOptions{
+		CA:       t.CA,
+		Cert:     t.Cert,
+		Pins:     t.Pins,
+		Insecure: t.Insecure,
+	}
+
+	if t.Key != "" {
+		if o.Key, err = a.sealer.seal([]byte(t.Key), tlsKeyContext(scope, target)); err != nil {
+			jsonError(err, w)
+			return
+		}
+	}
+
+	if err := model.SetTLSOptions(ctx, scope, target, o, tx); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if o, err = model.GetTLSOptions(ctx, scope, target, tx); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	if o.Insecure {
+		log.Printf("WARNING: TLS certificate verification disabled for %s %s", scope, target)
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(o); err != nil {
+		jsonError(err, w)
+		return
+	}
+}
+
+func (a *App) deleteTLSOptions(w http.ResponseWriter, r *http.Request, scope, target string) {
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	defer tx.Rollback()
+
+	if err := model.DeleteTLSOptions(r.Context(), scope, target, tx); err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	fmt.Fprint(w, `{"status":"ok"}`)
+}
+
+// feedTLSTarget resolves the feed in the route, so options are never
+// stored for a feed that does not exist.
+func (a *App) feedTLSTarget(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (string, bool) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		jsonInternalError(err, w)
+		return "", false
+	}
+
+	defer tx.Rollback()
+
+	feed, err := model.GetFeed(r.Context(), ps.ByName("id"), tx)
+	if err != nil {
+		jsonError(err, w)
+		return "", false
+	}
+
+	return feed.TLSTarget(), true
+}
+
+func (a *App) feedTLSHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if target, ok := a.feedTLSTarget(w, r, ps); ok {
+		a.getTLSOptions(w, r, model.TLSScopeFeed, target)
+	}
+}
+
+func (a *App) updateFeedTLSHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if target, ok := a.feedTLSTarget(w, r, ps); ok {
+		a.setTLSOptions(w, r, model.TLSScopeFeed, target)
+	}
+}
+
+func (a *App) deleteFeedTLSHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if target, ok := a.feedTLSTarget(w, r, ps); ok {
+		a.deleteTLSOptions(w, r, model.TLSScopeFeed, target)
+	}
+}
+
+func (a *App) hostTLSHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	a.getTLSOptions(w, r, model.TLSScopeHost, strings.ToLower(ps.ByName("host")))
+}
+
+func (a *App) updateHostTLSHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	a.setTLSOptions(w, r, model.TLSScopeHost, strings.ToLower(ps.ByName("host")))
+}
+
+func (a *App) deleteHostTLSHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	a.deleteTLSOptions(w, r, model.TLSScopeHost, strings.ToLower(ps.ByName("host")))
+}
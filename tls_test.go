@@ -0,0 +1,222 @@
+package backcast
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and its key, PEM encoded.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+
+	CertPEM string
+	KeyPEM  string
+}
+
+func (c testCert) pair(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	pair, err := tls.X509KeyPair([]byte(c.CertPEM), []byte(c.KeyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+// newTestCert issues a certificate from parent, or a self-signed CA when
+// parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert, usage x509.ExtKeyUsage) testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+		if usage == x509.ExtKeyUsageServerAuth {
+			tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testCert{
+		cert:    cert,
+		key:     key,
+		CertPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		KeyPEM:  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+	}
+}
+
+// newTestTLSServer serves testFeed with a certificate issued by ca. With
+// clientCA set, it requires a client certificate issued by that.
+func newTestTLSServer(t *testing.T, ca testCert, clientCA *testCert) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testFeed))
+	}))
+
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{newTestCert(t, "server", &ca, x509.ExtKeyUsageServerAuth).pair(t)},
+	}
+
+	if clientCA != nil {
+		pool := x509.NewCertPool()
+		pool.AddCert(clientCA.cert)
+		srv.TLS.ClientCAs = pool
+		srv.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestTLSSettings(t *testing.T) {
+	ca := newTestCert(t, "test CA", nil, 0)
+	otherCA := newTestCert(t, "other CA", nil, 0)
+	client := newTestCert(t, "client", &ca, x509.ExtKeyUsageClientAuth)
+
+	srv := newTestTLSServer(t, ca, nil)
+	mtls := newTestTLSServer(t, ca, &ca)
+
+	serverPin := spkiPin(srv.Certificate())
+	otherPin := spkiPin(otherCA.cert)
+
+	// a server that holds a key of its own and sends the pinned
+	// certificate along with it, which is public
+	otherLeaf := newTestCert(t, "server", &otherCA, x509.ExtKeyUsageServerAuth).pair(t)
+	otherLeaf.Certificate = append(otherLeaf.Certificate, srv.Certificate().Raw)
+	spoof := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testFeed))
+	}))
+	spoof.TLS = &tls.Config{Certificates: []tls.Certificate{otherLeaf}}
+	spoof.StartTLS()
+	defer spoof.Close()
+
+	fr := newFetcher(Config{}.withDefaults())
+
+	for _, c := range []struct {
+		name string
+		url  string
+		tls  *tlsSettings
+		err  string
+	}{
+		{"unknown CA", srv.URL, nil, "certificate signed by unknown authority"},
+		{"custom CA", srv.URL, &tlsSettings{CA: ca.CertPEM}, ""},
+		{"other CA", srv.URL, &tlsSettings{CA: otherCA.CertPEM}, "certificate signed by unknown authority"},
+		{"matching pin", srv.URL, &tlsSettings{CA: ca.CertPEM, Pins: []string{serverPin}}, ""},
+		{"mismatched pin", srv.URL, &tlsSettings{CA: ca.CertPEM, Pins: []string{otherPin}}, "matches a pinned key"},
+		{"mismatched pin, insecure", srv.URL, &tlsSettings{Insecure: true, Pins: []string{otherPin}}, "matches a pinned key"},
+		{"pinned certificate sent along", spoof.URL, &tlsSettings{CA: otherCA.CertPEM, Pins: []string{serverPin}}, "matches a pinned key"},
+		{"pinned certificate sent along, insecure", spoof.URL, &tlsSettings{Insecure: true, Pins: []string{serverPin}}, "matches a pinned key"},
+		{"insecure", srv.URL, &tlsSettings{Insecure: true}, ""},
+		{"no client certificate", mtls.URL, &tlsSettings{CA: ca.CertPEM}, "certificate required"},
+		{"client certificate", mtls.URL, &tlsSettings{CA: ca.CertPEM, Cert: client.CertPEM, Key: client.KeyPEM}, ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if c.tls != nil {
+				if err := c.tls.validate(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			req, err := http.NewRequest("GET", c.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := fr.fetch(context.Background(), req, feedSettings{TLS: c.tls})
+			switch {
+			case c.err == "" && err != nil:
+				t.Errorf("fetch failed: %v", err)
+			case c.err == "" && resp.StatusCode != http.StatusOK:
+				t.Errorf("fetch answered %d", resp.StatusCode)
+			case c.err != "" && err == nil:
+				t.Errorf("fetch succeeded, want an error containing %q", c.err)
+			case c.err != "" && !strings.Contains(err.Error(), c.err):
+				t.Errorf("fetch failed with %q, want %q", err, c.err)
+			}
+		})
+	}
+}
+
+// TestFeedTLSOptions stores a client certificate for a feed through the
+// API, so the key goes through the sealer, and checks the feed fetches.
+func TestFeedTLSOptions(t *testing.T) {
+	ca := newTestCert(t, "test CA", nil, 0)
+	client := newTestCert(t, "client", &ca, x509.ExtKeyUsageClientAuth)
+	srv := newTestTLSServer(t, ca, &ca)
+
+	a := newTestApp(t, Config{SecretKeyFile: testKeyFile(t)})
+	f := addTestFeed(t, a, srv.URL+"/feed.xml")
+
+	body, _ := json.Marshal(tlsSettings{CA: ca.CertPEM, Cert: client.CertPEM, Key: client.KeyPEM})
+	req := httptest.NewRequest("PUT", "/api/feed/"+strconv.FormatInt(f.ID, 10)+"/tls", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	a.routes().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("storing TLS options answered %d: %s", rec.Code, rec.Body)
+	}
+	if strings.Contains(rec.Body.String(), "PRIVATE KEY") {
+		t.Errorf("client key returned by the API: %s", rec.Body)
+	}
+
+	if _, ok, err := a.updateFeed(context.Background(), f); !ok || err != nil {
+		t.Fatalf("update with a client certificate: %v %v", ok, err)
+	}
+}
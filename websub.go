@@ -0,0 +1,578 @@
+package backcast
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/leedo/backcast/model"
+)
+
+const (
+	// how long to wait for a hub to verify or to retry a failed request
+	websubRetry = time.Hour
+)
+
+var websubSignatures = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// parseHubLinks finds the hub and self links a feed advertises, in the
+// Link header or as atom:link elements of the channel or feed.
+func parseHubLinks(h http.Header, body []byte) (string, string) {
+	var hub, self string
+
+	for _, v := range h["Link"] {
+		for _, link := range strings.Split(v, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			for _, p := range parts[1:] {
+				p = strings.TrimSpace(p)
+				if !strings.HasPrefix(strings.ToLower(p), "rel=") {
+					continue
+				}
+				for _, rel := range strings.Fields(strings.ToLower(strings.Trim(p[4:], `"`))) {
+					switch {
+					case rel == "hub" && hub == "":
+						hub = target
+					case rel == "self" && self == "":
+						self = target
+					}
+				}
+			}
+		}
+	}
+
+	var stack []string
+	dec := newXMLDecoder(body)
+
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name.Local)
+			if t.Name.Local != "link" || (t.Name.Space != atomNS && t.Name.Space != "atom") {
+				continue
+			}
+			if len(stack) < 2 || (stack[len(stack)-2] != "channel" && stack[len(stack)-2] != "feed") {
+				continue
+			}
+
+			var rel, href string
+			for _, attr := range t.Attr {
+				switch attr.Name.Local {
+				case "rel":
+					rel = strings.ToLower(attr.Value)
+				case "href":
+					href = attr.Value
+				}
+			}
+
+			switch {
+			case rel == "hub" && hub == "":
+				hub = href
+			case rel == "self" && self == "":
+				self = href
+			}
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+
+	if u, err := url.Parse(hub); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		hub = ""
+	}
+
+	return hub, self
+}
+
+func (a *App) websubCallback(f model.Feed) string {
+	return fmt.Sprintf("%s/websub/%d", strings.TrimRight(a.config.PublicURL, "/"), f.ID)
+}
+
+// syncSubscription subscribes to the hub a feed advertises, or
+// unsubscribes when the feed stops advertising one.
+func (a *App) syncSubscription(ctx context.Context, f model.Feed, resp *FetchResponse) error {
+	if a.config.PublicURL == "" || resp == nil || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	hub, topic := parseHubLinks(resp.Header, resp.Body)
+	if topic == "" {
+		topic = f.URL
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	sub, err := f.GetSubscription(ctx, tx)
+	tx.Rollback()
+
+	switch {
+	case err == sql.ErrNoRows:
+		if hub == "" {
+			return nil
+		}
+		return a.subscribe(ctx, f, model.Subscription{Hub: hub, Topic: topic})
+	case err != nil:
+		return err
+	case hub == "":
+		if sub.State == model.SubscriptionUnsubscribing || sub.State == model.SubscriptionDenied {
+			return nil
+		}
+		return a.unsubscribe(ctx, f, sub)
+	case sub.Hub != hub || sub.Topic != topic:
+		return a.subscribe(ctx, f, model.Subscription{Hub: hub, Topic: topic})
+	default:
+		return nil
+	}
+}
+
+func (a *App) saveSubscription(ctx context.Context, f model.Feed, sub model.Subscription) error {
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		return err
+	}
+
+	if err := f.SetSubscription(ctx, sub, tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func websubSecretContext(f model.Feed) []byte {
+	return sealContext("websub-secret", strconv.FormatInt(f.ID, 10))
+}
+
+// subscriptionSecret opens the secret shared with the hub, creating and
+// sealing one for a new subscription.
+func (a *App) subscriptionSecret(f model.Feed, sub *model.Subscription) (string, error) {
+	if len(sub.Secret) > 0 {
+		secret, err := a.sealer.open(sub.Secret, websubSecretContext(f))
+		if err != nil {
+			return "", fmt.Errorf("could not decrypt hub secret: %v", err)
+		}
+		return string(secret), nil
+	}
+
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+
+	secret := hex.EncodeToString(b)
+	sealed, err := a.sealer.seal([]byte(secret), websubSecretContext(f))
+	if err != nil {
+		return "", err
+	}
+	sub.Secret = sealed
+
+	return secret, nil
+}
+
+// subscribe asks the hub for a new or renewed subscription. A renewal
+// keeps its secret and stays active, so pushes keep arriving until the
+// hub verifies it again. The secret is only ever sent over https, so a
+// hub without it is recorded as failed and not retried.
+func (a *App) subscribe(ctx context.Context, f model.Feed, sub model.Subscription) error {
+	if u, err := url.Parse(sub.Hub); err != nil || u.Scheme != "https" {
+		sub.State = model.SubscriptionFailed
+		sub.LastError = "hub does not use https, not sending it a secret"
+		sub.RenewAt = nil
+		log.Printf("not subscribing feed %d (%s) to hub %s: %s", f.ID, sub.Topic, sub.Hub, sub.LastError)
+		return a.saveSubscription(ctx, f, sub)
+	}
+
+	secret, err := a.subscriptionSecret(f, &sub)
+	if err != nil {
+		return err
+	}
+
+	if sub.State != model.SubscriptionActive {
+		sub.State = model.SubscriptionPending
+	}
+
+	retry := time.Now().Add(websubRetry)
+	sub.RenewAt = &retry
+
+	// the hub may verify before it even answers, so the pending
+	// subscription has to be stored first
+	if err := a.saveSubscription(ctx, f, sub); err != nil {
+		return err
+	}
+
+	log.Printf("subscribing feed %d (%s) to hub %s", f.ID, sub.Topic, sub.Hub)
+
+	form := url.Values{
+		"hub.mode":     {"subscribe"},
+		"hub.topic":    {sub.Topic},
+		"hub.callback": {a.websubCallback(f)},
+		"hub.secret":   {secret},
+	}
+	if a.config.WebSubLease > 0 {
+		form.Set("hub.lease_seconds", strconv.FormatInt(int64(a.config.WebSubLease/time.Second), 10))
+	}
+
+	if err := a.hubRequest(ctx, sub.Hub, form); err != nil {
+		if sub.State != model.SubscriptionActive {
+			sub.State = model.SubscriptionFailed
+		}
+		sub.LastError = err.Error()
+		if err := a.saveSubscription(ctx, f, sub); err != nil {
+			return err
+		}
+		return fmt.Errorf("could not subscribe to hub %s: %v", sub.Hub, err)
+	}
+
+	return nil
+}
+
+func (a *App) unsubscribe(ctx context.Context, f model.Feed, sub model.Subscription) error {
+	log.Printf("unsubscribing feed %d (%s) from hub %s", f.ID, sub.Topic, sub.Hub)
+
+	sub.State = model.SubscriptionUnsubscribing
+	sub.RenewAt = nil
+	if err := a.saveSubscription(ctx, f, sub); err != nil {
+		return err
+	}
+
+	form := url.Values{
+		"hub.mode":     {"unsubscribe"},
+		"hub.topic":    {sub.Topic},
+		"hub.callback": {a.websubCallback(f)},
+	}
+
+	return a.hubRequest(ctx, sub.Hub, form)
+}
+
+func (a *App) hubRequest(ctx context.Context, hub string, form url.Values) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", hub, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// a private hub is verified with the TLS options of its host
+	var s feedSettings
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	host := feedHost(hub)
+	o, err := model.GetTLSOptions(ctx, model.TLSScopeHost, host, tx)
+	tx.Rollback()
+
+	if err == nil {
+		if s.TLS, err = a.openTLSOptions(o, model.TLSScopeHost, host); err != nil {
+			return err
+		}
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+
+	resp, err := a.fetcher.fetch(ctx, req, s)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// startWebSub renews leases before they run out and retries subscriptions
+// the hub failed or never verified.
+func (a *App) startWebSub(ctx context.Context) error {
+	t := time.NewTicker(a.config.ScanInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if err := a.renewSubscriptions(ctx); err != nil {
+				log.Printf("%v", err)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (a *App) renewSubscriptions(ctx context.Context) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	subs, err := model.FindDueSubscriptions(ctx, time.Now(), tx)
+	tx.Rollback()
+
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range subs {
+		f := model.Feed{ID: sub.Feed}
+		if err := a.subscribe(ctx, f, sub); err != nil {
+			log.Printf("failed to renew subscription for feed %d: %v", sub.Feed, err)
+		}
+	}
+
+	return nil
+}
+
+func (a *App) websubVerifyHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	q := r.URL.Query()
+
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	tx, err := a.beginWrite()
+	if err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	defer tx.Rollback()
+
+	f, err := model.GetFeed(ctx, ps.ByName("id"), tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	sub, err := f.GetSubscription(ctx, tx)
+	if err != nil || sub.Topic != q.Get("hub.topic") {
+		http.NotFound(w, r)
+		return
+	}
+
+	now := time.Now()
+
+	switch q.Get("hub.mode") {
+	case "subscribe":
+		if sub.State != model.SubscriptionPending && sub.State != model.SubscriptionActive {
+			http.NotFound(w, r)
+			return
+		}
+
+		lease, _ := strconv.ParseInt(q.Get("hub.lease_seconds"), 10, 64)
+		sub.State = model.SubscriptionActive
+		sub.LeaseSeconds = lease
+		sub.LastError = ""
+		sub.ExpiresAt, sub.RenewAt = nil, nil
+		if lease > 0 {
+			// renew with a tenth of the lease left
+			expires := now.Add(time.Duration(lease) * time.Second)
+			renew := now.Add(time.Duration(lease) * time.Second * 9 / 10)
+			sub.ExpiresAt, sub.RenewAt = &expires, &renew
+		}
+		err = f.SetSubscription(ctx, sub, tx)
+	case "unsubscribe":
+		if sub.State != model.SubscriptionUnsubscribing {
+			http.NotFound(w, r)
+			return
+		}
+		err = f.DeleteSubscription(ctx, tx)
+	case "denied":
+		sub.State = model.SubscriptionDenied
+		sub.LastError = q.Get("hub.reason")
+		sub.RenewAt = nil
+		err = f.SetSubscription(ctx, sub, tx)
+	default:
+		http.Error(w, "unknown hub.mode", http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	log.Printf("hub %s verified %s of feed %d (%s)", sub.Hub, q.Get("hub.mode"), f.ID, sub.Topic)
+
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(w, q.Get("hub.challenge"))
+}
+
+// validSignature checks an X-Hub-Signature header of the form
+// method=hexdigest against the subscription secret.
+func validSignature(header string, secret string, body []byte) bool {
+	i := strings.IndexByte(header, '=')
+	if i < 0 {
+		return false
+	}
+
+	h, ok := websubSignatures[strings.ToLower(header[:i])]
+	if !ok {
+		return false
+	}
+
+	sig, err := hex.DecodeString(header[i+1:])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+func (a *App) websubContentHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	f, err := model.GetFeed(ctx, ps.ByName("id"), tx)
+	if err != nil {
+		tx.Rollback()
+		jsonError(err, w)
+		return
+	}
+
+	sub, err := f.GetSubscription(ctx, tx)
+	if err != nil || sub.State != model.SubscriptionActive {
+		tx.Rollback()
+		http.NotFound(w, r)
+		return
+	}
+
+	settings, err := a.loadFeedSettings(ctx, f, tx)
+	tx.Rollback()
+
+	if err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	limit := bodyLimit(a.config, settings.Options)
+
+	var body io.Reader = r.Body
+	if limit > 0 {
+		body = io.LimitReader(r.Body, limit+1)
+	}
+
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	if limit > 0 && int64(len(b)) > limit {
+		http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	secret, err := a.sealer.open(sub.Secret, websubSecretContext(f))
+	if err != nil {
+		log.Printf("could not decrypt hub secret of feed %d (%s): %v", f.ID, f.URL, err)
+	}
+
+	// the hub has to be told the content arrived even when it is not
+	// trusted, so a bad signature is only logged
+	if err != nil || !validSignature(r.Header.Get("X-Hub-Signature"), string(secret), b) {
+		log.Printf("ignoring content for feed %d (%s) with a missing or invalid signature", f.ID, f.URL)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	if len(b) == 0 {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	resp := &FetchResponse{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     http.Header{"Content-Type": {r.Header.Get("Content-Type")}},
+		Body:       b,
+	}
+
+	if ok, err := a.commitPushed(ctx, f, resp); err != nil {
+		log.Printf("failed to store pushed content for feed %d (%s): %v", f.ID, f.URL, err)
+		jsonInternalError(err, w)
+		return
+	} else if ok {
+		log.Printf("updated feed %d (%s) from hub %s", f.ID, f.URL, sub.Hub)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (a *App) feedSubscriptionHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		jsonInternalError(err, w)
+		return
+	}
+
+	defer tx.Rollback()
+
+	f, err := model.GetFeed(ctx, ps.ByName("id"), tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	sub, err := f.GetSubscription(ctx, tx)
+	if err != nil {
+		jsonError(err, w)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(sub); err != nil {
+		jsonError(err, w)
+		return
+	}
+}
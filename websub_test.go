@@ -0,0 +1,231 @@
+package backcast
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leedo/backcast/model"
+)
+
+// testHub is a stand-in WebSub hub. It verifies intent with the
+// subscriber before answering a subscription request.
+type testHub struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	requests []url.Values
+	verified int
+}
+
+func (h *testHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.mu.Lock()
+	h.requests = append(h.requests, r.PostForm)
+	h.mu.Unlock()
+
+	challenge := fmt.Sprintf("challenge-%d", time.Now().UnixNano())
+	verify, err := url.Parse(r.PostForm.Get("hub.callback"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	verify.RawQuery = url.Values{
+		"hub.mode":          {r.PostForm.Get("hub.mode")},
+		"hub.topic":         {r.PostForm.Get("hub.topic")},
+		"hub.challenge":     {challenge},
+		"hub.lease_seconds": {"3600"},
+	}.Encode()
+
+	resp, err := http.Get(verify.String())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != challenge {
+		h.t.Errorf("subscriber answered challenge %q with %q", challenge, body)
+		http.Error(w, "intent not verified", http.StatusBadRequest)
+		return
+	}
+
+	h.mu.Lock()
+	h.verified++
+	h.mu.Unlock()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *testHub) last() url.Values {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.requests[len(h.requests)-1]
+}
+
+func testSubscription(t *testing.T, a *App, f model.Feed) model.Subscription {
+	t.Helper()
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer tx.Rollback()
+
+	sub, err := f.GetSubscription(context.Background(), tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sub
+}
+
+func TestWebSub(t *testing.T) {
+	hub := &testHub{t: t}
+	hubSrv := httptest.NewTLSServer(hub)
+	defer hubSrv.Close()
+
+	var feedSrv *httptest.Server
+	feedSrv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom"><channel>
+<atom:link rel="hub" href="%s"/>
+<atom:link rel="self" href="%s/feed.xml"/>
+<item><guid>1</guid></item>
+</channel></rss>`, hubSrv.URL, feedSrv.URL)
+	}))
+	defer feedSrv.Close()
+
+	a := newTestApp(t, Config{SecretKeyFile: testKeyFile(t), PublicURL: "http://subscriber.invalid"})
+
+	appSrv := httptest.NewServer(a.routes())
+	defer appSrv.Close()
+	a.config.PublicURL = appSrv.URL
+
+	ctx := context.Background()
+
+	// the hub's certificate is trusted through the TLS options of its host
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: hubSrv.Certificate().Raw})
+	tx, err := a.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := model.SetTLSOptions(ctx, model.TLSScopeHost, feedHost(hubSrv.URL), model.TLSOptions{CA: string(ca)}, tx); err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+
+	f := addTestFeed(t, a, feedSrv.URL+"/feed.xml")
+	if _, err := a.checkFeed(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+
+	sub := testSubscription(t, a, f)
+	if sub.State != model.SubscriptionActive || hub.verified != 1 {
+		t.Fatalf("subscription is %s after %d verifications, want active after 1", sub.State, hub.verified)
+	}
+	if sub.ExpiresAt == nil || sub.ExpiresAt.Before(time.Now().Add(59*time.Minute)) {
+		t.Errorf("lease expires at %v, want an hour out", sub.ExpiresAt)
+	}
+
+	secret := hub.last().Get("hub.secret")
+	if secret == "" {
+		t.Fatal("no secret sent to the hub")
+	}
+	if bytes.Contains(sub.Secret, []byte(secret)) {
+		t.Error("hub secret is stored in the clear")
+	}
+
+	push := func(body, secret string) {
+		t.Helper()
+
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(body))
+
+		req, _ := http.NewRequest("POST", a.websubCallback(f), bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/rss+xml")
+		req.Header.Set("X-Hub-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusAccepted {
+			t.Errorf("push answered %s, want 202", resp.Status)
+		}
+	}
+
+	push(`<rss version="2.0"><channel><item><guid>2</guid></item></channel></rss>`, secret)
+	if n := len(feedHistory(t, a, f)); n != 2 {
+		t.Fatalf("history has %d revisions after a signed push, want 2", n)
+	}
+
+	push(`<rss version="2.0"><channel><item><guid>3</guid></item></channel></rss>`, "not the secret")
+	if n := len(feedHistory(t, a, f)); n != 2 {
+		t.Fatalf("history has %d revisions after a forged push, want 2", n)
+	}
+
+	// renewing keeps the secret and is verified again
+	if _, err := a.db.Exec(`UPDATE websub_subscription SET renew_at=? WHERE feed=?`, time.Now().Add(-time.Minute), f.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.renewSubscriptions(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if hub.verified != 2 {
+		t.Errorf("hub verified %d times after renewal, want 2", hub.verified)
+	}
+	if got := hub.last().Get("hub.secret"); got != secret {
+		t.Errorf("renewal sent secret %q, want the original", got)
+	}
+	if sub = testSubscription(t, a, f); sub.State != model.SubscriptionActive || sub.RenewAt == nil || !sub.RenewAt.After(time.Now()) {
+		t.Errorf("renewed subscription is %s renewing at %v", sub.State, sub.RenewAt)
+	}
+}
+
+func TestWebSubPlainHTTPHub(t *testing.T) {
+	hub := &testHub{t: t}
+	hubSrv := httptest.NewServer(hub)
+	defer hubSrv.Close()
+
+	feedSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom"><channel>
+<atom:link rel="hub" href="%s"/>
+</channel></rss>`, hubSrv.URL)
+	}))
+	defer feedSrv.Close()
+
+	a := newTestApp(t, Config{SecretKeyFile: testKeyFile(t), PublicURL: "http://subscriber.invalid"})
+	f := addTestFeed(t, a, feedSrv.URL+"/feed.xml")
+
+	if _, err := a.checkFeed(context.Background(), f); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hub.requests) != 0 {
+		t.Errorf("sent %d requests with a secret to a plain http hub", len(hub.requests))
+	}
+	if sub := testSubscription(t, a, f); sub.State != model.SubscriptionFailed || sub.RenewAt != nil {
+		t.Errorf("subscription to plain http hub is %s renewing at %v, want failed for good", sub.State, sub.RenewAt)
+	}
+}
@@ -0,0 +1,32 @@
+package backcast
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+)
+
+// newXMLDecoder returns a lenient decoder for feed bodies, which are often
+// not quite well-formed and may declare any encoding.
+func newXMLDecoder(body []byte) *xml.Decoder {
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	dec.Strict = false
+	dec.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	return dec
+}
+
+// rootElement returns the local name of the first element in body.
+func rootElement(body []byte) string {
+	dec := newXMLDecoder(body)
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return ""
+		}
+		if t, ok := tok.(xml.StartElement); ok {
+			return t.Name.Local
+		}
+	}
+}